@@ -0,0 +1,416 @@
+// Package cache is a bounded, expiring cache on top of safemap.
+//
+// Entries can have a time to live; a janitor goroutine removes expired
+// ones in the background and Get never returns them. The cache can be
+// bounded by number of entries and by total cost, evicting the least
+// recently (LRU) or least frequently (LFU) used entries to stay within
+// bounds:
+//
+//	c := cache.New(ctx, cache.Options[string, []byte]{
+//		MaxCost:    64 << 20,
+//		Cost:       func(k string, v []byte) int64 { return int64(len(v)) },
+//		DefaultTTL: time.Minute,
+//	})
+//	defer c.Close()
+//
+// Lookups go straight to the sharded map. Recording an access needs the
+// eviction policy's lock; when another goroutine holds it the access is
+// not recorded rather than waited for, so busy readers do not queue.
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"safemap"
+)
+
+// Policy picks which entry to evict when the cache is full
+type Policy int
+
+const (
+	LRU Policy = iota // least recently used (default)
+	LFU               // least frequently used, oldest first among equals
+)
+
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "lru"
+	case LFU:
+		return "lfu"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Reason says why an entry left the cache
+type Reason int
+
+const (
+	Expired Reason = iota // its TTL passed
+	Evicted               // the cache was over its bounds
+	Deleted               // Delete was called or the key was set again
+)
+
+func (r Reason) String() string {
+	switch r {
+	case Expired:
+		return "expired"
+	case Evicted:
+		return "evicted"
+	case Deleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// Options configures a Cache. Zero bounds mean unbounded.
+type Options[K comparable, V any] struct {
+	MaxEntries int
+	MaxCost    int64
+	Cost       func(key K, value V) int64 // default 1 per entry
+	Policy     Policy
+
+	// DefaultTTL applies to Set; zero means entries do not expire
+	DefaultTTL time.Duration
+	// JanitorInterval is how often expired entries are swept (default 1s)
+	JanitorInterval time.Duration
+
+	// OnEvict is called, without any lock held, for every entry that
+	// leaves the cache
+	OnEvict func(key K, value V, reason Reason)
+}
+
+// Stats counts what the cache did
+type Stats struct {
+	Hits        int64
+	Misses      int64
+	Evictions   int64 // removed to stay within bounds
+	Expirations int64
+	Entries     int
+	Cost        int64
+}
+
+// HitRatio returns hits over lookups, or 0 before the first lookup
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int64
+	expires int64 // Unix nanoseconds, 0 for never
+
+	elem  *list.Element // LRU position
+	freq  int64         // LFU use count
+	tick  uint64        // LFU tie break: last use
+	index int           // LFU heap position
+}
+
+func (e *entry[K, V]) expired(now int64) bool {
+	return e.expires != 0 && now >= e.expires
+}
+
+// Cache is a concurrent cache with expiry and eviction
+type Cache[K comparable, V any] struct {
+	opts Options[K, V]
+	data *safemap.SafeMap[K, *entry[K, V]]
+
+	// mu guards every change to data and the eviction order
+	mu     sync.Mutex
+	policy policy[K, V]
+	cost   int64
+
+	hits, misses, evictions, expirations atomic.Int64
+
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// New returns an empty cache. Its janitor runs until ctx is done or Close
+// is called.
+func New[K comparable, V any](ctx context.Context, opts Options[K, V]) *Cache[K, V] {
+	if opts.Cost == nil {
+		opts.Cost = func(K, V) int64 { return 1 }
+	}
+	if opts.JanitorInterval <= 0 {
+		opts.JanitorInterval = time.Second
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	c := &Cache[K, V]{
+		opts:    opts,
+		data:    safemap.New[K, *entry[K, V]](),
+		stop:    stop,
+		stopped: make(chan struct{}),
+	}
+	if opts.Policy == LFU {
+		c.policy = &lfu[K, V]{}
+	} else {
+		c.policy = &lru[K, V]{order: list.New()}
+	}
+	go c.janitor(ctx)
+	return c
+}
+
+// Close stops the janitor and waits for it to exit. The cache stays
+// usable; expired entries are then only dropped when looked up.
+func (c *Cache[K, V]) Close() {
+	c.stop()
+	<-c.stopped
+}
+
+// Get returns the value under key if it is there and has not expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	e, ok := c.data.Get(key)
+	if ok && e.expired(time.Now().UnixNano()) {
+		c.expire(e)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		var zero V
+		return zero, false
+	}
+
+	c.hits.Add(1)
+	if c.mu.TryLock() {
+		// The entry may have been removed since the lookup
+		if cur, ok := c.data.Get(key); ok && cur == e {
+			c.policy.touch(e)
+		}
+		c.mu.Unlock()
+	}
+	return e.value, true
+}
+
+// Set stores value under key with the default TTL
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.opts.DefaultTTL)
+}
+
+// SetWithTTL stores value under key; it expires after ttl unless ttl is 0.
+// A value costing more than MaxCost replaces the old value under key but
+// is not stored: OnEvict gets it right away, and nothing else is evicted.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	e := &entry[K, V]{key: key, value: value, cost: c.opts.Cost(key, value)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl).UnixNano()
+	}
+
+	var gone []removal[K, V]
+	c.mu.Lock()
+	if old, ok := c.data.Get(key); ok {
+		gone = append(gone, c.remove(old, Deleted))
+	}
+	if c.opts.MaxCost > 0 && e.cost > c.opts.MaxCost {
+		c.evictions.Add(1)
+		gone = append(gone, removal[K, V]{e, Evicted})
+	} else {
+		c.data.Set(key, e)
+		c.cost += e.cost
+		// Make room among the older entries first: under LFU the new
+		// entry is always the least used and would otherwise never get in
+		for c.over() && c.policy.Len() > 0 {
+			gone = append(gone, c.remove(c.policy.victim(), Evicted))
+		}
+		c.policy.add(e)
+	}
+	c.mu.Unlock()
+
+	c.notify(gone)
+}
+
+// Delete removes key
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	e, ok := c.data.Get(key)
+	var r removal[K, V]
+	if ok {
+		r = c.remove(e, Deleted)
+	}
+	c.mu.Unlock()
+	if ok {
+		c.notify([]removal[K, V]{r})
+	}
+}
+
+// Len returns the number of entries, including expired ones the janitor
+// has not swept yet
+func (c *Cache[K, V]) Len() int {
+	return c.data.Len()
+}
+
+// Stats returns the counts so far
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	cost := c.cost
+	c.mu.Unlock()
+	return Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Entries:     c.data.Len(),
+		Cost:        cost,
+	}
+}
+
+func (c *Cache[K, V]) over() bool {
+	return (c.opts.MaxEntries > 0 && c.data.Len() > c.opts.MaxEntries) ||
+		(c.opts.MaxCost > 0 && c.cost > c.opts.MaxCost)
+}
+
+// removal is an entry that left, reported to OnEvict after unlocking
+type removal[K comparable, V any] struct {
+	e      *entry[K, V]
+	reason Reason
+}
+
+// remove drops e; the caller holds c.mu
+func (c *Cache[K, V]) remove(e *entry[K, V], reason Reason) removal[K, V] {
+	c.data.Delete(e.key)
+	c.cost -= e.cost
+	c.policy.remove(e)
+	switch reason {
+	case Evicted:
+		c.evictions.Add(1)
+	case Expired:
+		c.expirations.Add(1)
+	}
+	return removal[K, V]{e, reason}
+}
+
+// expire removes e if it is still the entry under its key
+func (c *Cache[K, V]) expire(e *entry[K, V]) {
+	c.mu.Lock()
+	cur, ok := c.data.Get(e.key)
+	ok = ok && cur == e
+	var r removal[K, V]
+	if ok {
+		r = c.remove(e, Expired)
+	}
+	c.mu.Unlock()
+	if ok {
+		c.notify([]removal[K, V]{r})
+	}
+}
+
+func (c *Cache[K, V]) notify(gone []removal[K, V]) {
+	if c.opts.OnEvict == nil {
+		return
+	}
+	for _, r := range gone {
+		c.opts.OnEvict(r.e.key, r.e.value, r.reason)
+	}
+}
+
+// janitor sweeps expired entries every JanitorInterval
+func (c *Cache[K, V]) janitor(ctx context.Context) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.opts.JanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Cache[K, V]) sweep() {
+	now := time.Now().UnixNano()
+	var gone []removal[K, V]
+	c.mu.Lock()
+	c.data.Range(func(_ K, e *entry[K, V]) bool {
+		if e.expired(now) {
+			gone = append(gone, c.remove(e, Expired))
+		}
+		return true
+	})
+	c.mu.Unlock()
+	c.notify(gone)
+}
+
+// policy keeps entries in eviction order; the cache holds its lock
+type policy[K comparable, V any] interface {
+	add(e *entry[K, V])
+	touch(e *entry[K, V])
+	remove(e *entry[K, V])
+	victim() *entry[K, V]
+	Len() int
+}
+
+type lru[K comparable, V any] struct {
+	order *list.List // most recently used first
+}
+
+func (p *lru[K, V]) add(e *entry[K, V])    { e.elem = p.order.PushFront(e) }
+func (p *lru[K, V]) touch(e *entry[K, V])  { p.order.MoveToFront(e.elem) }
+func (p *lru[K, V]) remove(e *entry[K, V]) { p.order.Remove(e.elem) }
+func (p *lru[K, V]) Len() int              { return p.order.Len() }
+
+func (p *lru[K, V]) victim() *entry[K, V] {
+	return p.order.Back().Value.(*entry[K, V])
+}
+
+// lfu is a min-heap on use count, then on last use
+type lfu[K comparable, V any] struct {
+	entries []*entry[K, V]
+	clock   uint64
+}
+
+func (p *lfu[K, V]) add(e *entry[K, V]) {
+	p.clock++
+	e.freq, e.tick = 1, p.clock
+	heap.Push(p, e)
+}
+
+func (p *lfu[K, V]) touch(e *entry[K, V]) {
+	p.clock++
+	e.freq++
+	e.tick = p.clock
+	heap.Fix(p, e.index)
+}
+
+func (p *lfu[K, V]) remove(e *entry[K, V]) { heap.Remove(p, e.index) }
+func (p *lfu[K, V]) victim() *entry[K, V]  { return p.entries[0] }
+
+func (p *lfu[K, V]) Len() int { return len(p.entries) }
+
+func (p *lfu[K, V]) Less(i, j int) bool {
+	a, b := p.entries[i], p.entries[j]
+	if a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.tick < b.tick
+}
+
+func (p *lfu[K, V]) Swap(i, j int) {
+	p.entries[i], p.entries[j] = p.entries[j], p.entries[i]
+	p.entries[i].index = i
+	p.entries[j].index = j
+}
+
+func (p *lfu[K, V]) Push(x any) {
+	e := x.(*entry[K, V])
+	e.index = len(p.entries)
+	p.entries = append(p.entries, e)
+}
+
+func (p *lfu[K, V]) Pop() any {
+	e := p.entries[len(p.entries)-1]
+	p.entries = p.entries[:len(p.entries)-1]
+	return e
+}
@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// evictions records OnEvict calls
+type evictions struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (ev *evictions) record(key string, _ int, reason Reason) {
+	ev.mu.Lock()
+	ev.got = append(ev.got, key+":"+reason.String())
+	ev.mu.Unlock()
+}
+
+func (ev *evictions) String() string {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return fmt.Sprint(ev.got)
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		want   string
+	}{
+		// a was used most often but longest ago
+		{LRU, "[a:evicted]"},
+		// b and c were used as often; b less recently
+		{LFU, "[b:evicted]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			var ev evictions
+			c := New(context.Background(), Options[string, int]{
+				MaxEntries: 3,
+				Policy:     tt.policy,
+				OnEvict:    ev.record,
+			})
+			defer c.Close()
+
+			c.Set("a", 1)
+			c.Set("b", 2)
+			c.Set("c", 3)
+			c.Get("a")
+			c.Get("a")
+			c.Get("b")
+			c.Get("c")
+			c.Set("d", 4)
+
+			if ev.String() != tt.want {
+				t.Fatalf("evicted %s, want %s", ev.String(), tt.want)
+			}
+			if c.Len() != 3 {
+				t.Fatalf("Len = %d", c.Len())
+			}
+		})
+	}
+}
+
+func TestMaxCost(t *testing.T) {
+	var ev evictions
+	c := New(context.Background(), Options[string, int]{
+		MaxCost: 10,
+		Cost:    func(_ string, v int) int64 { return int64(v) },
+		OnEvict: ev.record,
+	})
+	defer c.Close()
+
+	c.Set("a", 4)
+	c.Set("b", 4)
+	c.Set("a", 5) // replaces a, now the most recent
+	c.Set("c", 3) // 4+5+3 > 10, so b goes
+	if s := c.Stats(); s.Cost != 8 || s.Entries != 2 || s.Evictions != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+	c.Set("huge", 11) // larger than the whole cache: turned away alone
+	if s := c.Stats(); s.Cost != 8 || s.Entries != 2 || s.Evictions != 2 {
+		t.Fatalf("stats %+v after setting an oversized entry", s)
+	}
+	c.Set("a", 11) // the old a goes all the same
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Fatalf("a still cached, Len = %d", c.Len())
+	}
+	want := "[a:deleted b:evicted huge:evicted a:deleted a:evicted]"
+	if ev.String() != want {
+		t.Fatalf("callbacks %s, want %s", ev.String(), want)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	var ev evictions
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(ctx, Options[string, int]{
+		DefaultTTL:      30 * time.Millisecond,
+		JanitorInterval: 10 * time.Millisecond,
+		OnEvict:         ev.record,
+	})
+
+	c.Set("short", 1)
+	c.SetWithTTL("forever", 2, 0)
+	c.SetWithTTL("lookup", 3, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("lookup"); ok {
+		t.Fatal("Get returned an expired entry")
+	}
+	if _, ok := c.Get("short"); !ok {
+		t.Fatal("short expired early")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := c.Get("forever"); !ok || c.Len() != 1 {
+		t.Fatalf("janitor left %d entries", c.Len())
+	}
+
+	s := c.Stats()
+	if s.Expirations != 2 || s.Hits != 2 || s.Misses != 1 || s.HitRatio() < 0.66 {
+		t.Fatalf("stats %+v", s)
+	}
+	if ev.String() != "[lookup:expired short:expired]" {
+		t.Fatalf("callbacks %s", ev.String())
+	}
+
+	// Cancelling the context stops the janitor; Close still returns
+	cancel()
+	done := make(chan struct{})
+	go func() { c.Close(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close hung after the context was cancelled")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	c := New(context.Background(), Options[int, int]{
+		MaxEntries:      100,
+		Policy:          LFU,
+		DefaultTTL:      20 * time.Millisecond,
+		JanitorInterval: time.Millisecond,
+	})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := (w*7 + i) % 300
+				if v, ok := c.Get(k); ok && v != k {
+					t.Errorf("Get(%d) = %d", k, v)
+				}
+				c.Set(k, k)
+				if i%10 == 0 {
+					c.Delete(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if s := c.Stats(); s.Entries > 100 || s.Cost != int64(s.Entries) {
+		t.Fatalf("stats %+v", s)
+	}
+}
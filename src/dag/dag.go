@@ -0,0 +1,298 @@
+// Package dag runs tasks with dependencies on a worker pool.
+//
+// Each task names the tasks it depends on. Tasks whose dependencies have
+// all succeeded run in parallel and receive their upstream outputs; if a
+// task fails, everything downstream of it is cancelled while unrelated
+// branches keep going. Cycles and unknown dependencies are rejected before
+// anything runs.
+package dag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"workerpool"
+)
+
+var (
+	// ErrCycle is returned when the tasks depend on each other in a loop
+	ErrCycle = errors.New("dag: dependency cycle")
+
+	// ErrMissingDependency is returned when a task depends on an unknown ID
+	ErrMissingDependency = errors.New("dag: missing dependency")
+
+	// ErrUpstreamFailed is the error of a task cancelled because a task it
+	// depends on failed
+	ErrUpstreamFailed = errors.New("dag: upstream task failed")
+)
+
+// Func runs one task. upstream holds the outputs of the task's direct
+// dependencies, keyed by task ID.
+type Func[In, Out any] func(ctx context.Context, in In, upstream map[int]Out) (Out, error)
+
+// Status says how a task ended
+type Status int
+
+const (
+	Pending Status = iota
+	Succeeded
+	Failed
+	Cancelled
+)
+
+func (s Status) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Cancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// TaskResult is the outcome of one task
+type TaskResult[Out any] struct {
+	ID       int
+	Status   Status
+	Output   Out
+	Err      error
+	WorkerID int
+}
+
+type node[In any] struct {
+	id        int
+	input     In
+	dependsOn []int
+}
+
+// Graph is a set of tasks and their dependencies
+type Graph[In any] struct {
+	nodes map[int]*node[In]
+	order []int // insertion order, keeps plans stable
+}
+
+// New returns an empty graph
+func New[In any]() *Graph[In] {
+	return &Graph[In]{nodes: make(map[int]*node[In])}
+}
+
+// Add adds a task that runs after every task in dependsOn has succeeded
+func (g *Graph[In]) Add(id int, input In, dependsOn ...int) error {
+	if _, ok := g.nodes[id]; ok {
+		return fmt.Errorf("dag: task %d added twice", id)
+	}
+	g.nodes[id] = &node[In]{id: id, input: input, dependsOn: dependsOn}
+	g.order = append(g.order, id)
+	return nil
+}
+
+// Len returns the number of tasks in the graph
+func (g *Graph[In]) Len() int {
+	return len(g.nodes)
+}
+
+// Plan validates the graph and groups tasks into stages: every task only
+// depends on tasks in earlier stages, so each stage can run in parallel.
+// Within a stage tasks are in the order they were added.
+func (g *Graph[In]) Plan() ([][]int, error) {
+	indegree, children, err := g.edges()
+	if err != nil {
+		return nil, err
+	}
+
+	var stages [][]int
+	var ready []int
+	pos := make(map[int]int, len(g.order))
+	for i, id := range g.order {
+		pos[id] = i
+		if indegree[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	done := 0
+	for len(ready) > 0 {
+		stages = append(stages, ready)
+		done += len(ready)
+
+		var next []int
+		for _, id := range ready {
+			for _, child := range children[id] {
+				indegree[child]--
+				if indegree[child] == 0 {
+					next = append(next, child)
+				}
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return pos[next[i]] < pos[next[j]] })
+		ready = next
+	}
+
+	if done != len(g.nodes) {
+		var stuck []int
+		for _, id := range g.order {
+			if indegree[id] > 0 {
+				stuck = append(stuck, id)
+			}
+		}
+		return nil, fmt.Errorf("%w between tasks %v", ErrCycle, stuck)
+	}
+	return stages, nil
+}
+
+// PrintPlan writes the execution plan without running anything (dry run)
+func (g *Graph[In]) PrintPlan(w io.Writer) error {
+	stages, err := g.Plan()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Execution plan: %d tasks in %d stages\n", len(g.nodes), len(stages))
+	for i, stage := range stages {
+		fmt.Fprintf(w, "Stage %d:\n", i+1)
+		for _, id := range stage {
+			if deps := g.nodes[id].dependsOn; len(deps) > 0 {
+				fmt.Fprintf(w, "  task %d (after %v)\n", id, deps)
+			} else {
+				fmt.Fprintf(w, "  task %d\n", id)
+			}
+		}
+	}
+	return nil
+}
+
+// edges returns the number of unfinished dependencies of each task and the
+// tasks that depend on each task
+func (g *Graph[In]) edges() (map[int]int, map[int][]int, error) {
+	indegree := make(map[int]int, len(g.nodes))
+	children := make(map[int][]int, len(g.nodes))
+	for _, id := range g.order {
+		n := g.nodes[id]
+		for _, dep := range n.dependsOn {
+			if _, ok := g.nodes[dep]; !ok {
+				return nil, nil, fmt.Errorf("%w: task %d depends on %d", ErrMissingDependency, id, dep)
+			}
+			indegree[id]++
+			children[dep] = append(children[dep], id)
+		}
+	}
+	return indegree, children, nil
+}
+
+// work is what the scheduler hands to the pool for one task
+type work[In, Out any] struct {
+	input    In
+	upstream map[int]Out
+}
+
+// Run executes the graph on a pool of workers. The returned error joins
+// the errors of every task that failed; results has an entry for every task.
+func Run[In, Out any](ctx context.Context, g *Graph[In], workers int, fn Func[In, Out], opts ...workerpool.Option) (map[int]TaskResult[Out], error) {
+	if _, err := g.Plan(); err != nil {
+		return nil, err
+	}
+	indegree, children, _ := g.edges()
+
+	// Queue as large as the graph so the scheduler never blocks on Submit
+	// while workers wait to hand back results. It goes last so no option
+	// can shrink it.
+	opts = append(opts[:len(opts):len(opts)], workerpool.WithQueueSize(len(g.nodes)))
+	pool := workerpool.New(ctx, workers, func(ctx context.Context, workerID int, w work[In, Out]) (Out, error) {
+		return fn(ctx, w.input, w.upstream)
+	}, opts...)
+
+	results := make(map[int]TaskResult[Out], len(g.nodes))
+	for _, id := range g.order {
+		results[id] = TaskResult[Out]{ID: id}
+	}
+	pending := len(g.nodes)
+
+	// cancel marks everything downstream of a failed task as cancelled
+	var cancel func(id int)
+	cancel = func(id int) {
+		for _, child := range children[id] {
+			if results[child].Status != Pending {
+				continue
+			}
+			results[child] = TaskResult[Out]{
+				ID:     child,
+				Status: Cancelled,
+				Err:    fmt.Errorf("%w: task %d", ErrUpstreamFailed, id),
+			}
+			pending--
+			cancel(child)
+		}
+	}
+
+	submit := func(id int) {
+		n := g.nodes[id]
+		upstream := make(map[int]Out, len(n.dependsOn))
+		for _, dep := range n.dependsOn {
+			upstream[dep] = results[dep].Output
+		}
+		if err := pool.Submit(ctx, id, work[In, Out]{input: n.input, upstream: upstream}); err != nil {
+			results[id] = TaskResult[Out]{ID: id, Status: Cancelled, Err: err}
+			pending--
+			cancel(id)
+		}
+	}
+
+	for _, id := range g.order {
+		if indegree[id] == 0 {
+			submit(id)
+		}
+	}
+	if pending == 0 {
+		pool.Close()
+	}
+
+	for res := range pool.Results() {
+		if res.Err != nil {
+			results[res.JobID] = TaskResult[Out]{ID: res.JobID, Status: Failed, Err: res.Err, WorkerID: res.WorkerID}
+			pending--
+			cancel(res.JobID)
+		} else {
+			results[res.JobID] = TaskResult[Out]{ID: res.JobID, Status: Succeeded, Output: res.Value, WorkerID: res.WorkerID}
+			pending--
+			for _, child := range children[res.JobID] {
+				indegree[child]--
+				if indegree[child] == 0 && results[child].Status == Pending {
+					submit(child)
+				}
+			}
+		}
+		if pending == 0 {
+			pool.Close()
+		}
+	}
+
+	// Anything still pending was cut off because the pool stopped early
+	cause := pool.Err()
+	if cause == nil {
+		cause = context.Cause(ctx)
+	}
+
+	var errs []error
+	stopped := false
+	for _, id := range g.order {
+		r := results[id]
+		if r.Status == Pending {
+			r.Status, r.Err = Cancelled, cause
+			results[id] = r
+			stopped = true
+		}
+		if r.Status == Failed {
+			errs = append(errs, fmt.Errorf("task %d: %w", id, r.Err))
+		}
+	}
+	if stopped && cause != nil {
+		errs = append(errs, cause)
+	}
+	return results, errors.Join(errs...)
+}
@@ -0,0 +1,117 @@
+package dag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"workerpool"
+)
+
+func TestRunPassesOutputsDownstream(t *testing.T) {
+	g := New[int]()
+	g.Add(1, 1)
+	g.Add(2, 2)
+	g.Add(3, 0, 1, 2) // sums its inputs
+	g.Add(4, 10, 3)
+
+	results, err := Run(context.Background(), g, 2, func(ctx context.Context, in int, upstream map[int]int) (int, error) {
+		for _, v := range upstream {
+			in += v
+		}
+		return in, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[4].Output; got != 13 {
+		t.Errorf("task 4 = %d; expected 13", got)
+	}
+
+	// A caller's queue size cannot make the scheduler and workers wait
+	// on each other
+	done := make(chan error, 1)
+	go func() {
+		_, err := Run(context.Background(), g, 1, func(ctx context.Context, in int, upstream map[int]int) (int, error) {
+			return in, nil
+		}, workerpool.WithQueueSize(0))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run with WithQueueSize(0) deadlocked")
+	}
+}
+
+func TestRunCancelsDependentsOnFailure(t *testing.T) {
+	g := New[string]()
+	g.Add(1, "ok")
+	g.Add(2, "fail")
+	g.Add(3, "ok", 2)
+	g.Add(4, "ok", 3)
+	g.Add(5, "ok", 1)
+
+	results, err := Run(context.Background(), g, 3, func(ctx context.Context, in string, upstream map[int]string) (string, error) {
+		if in == "fail" {
+			return "", errors.New("boom")
+		}
+		return in, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Run error = %v; expected boom", err)
+	}
+
+	expected := map[int]Status{1: Succeeded, 2: Failed, 3: Cancelled, 4: Cancelled, 5: Succeeded}
+	for id, status := range expected {
+		if results[id].Status != status {
+			t.Errorf("task %d is %v; expected %v", id, results[id].Status, status)
+		}
+	}
+	if !errors.Is(results[4].Err, ErrUpstreamFailed) {
+		t.Errorf("task 4 error = %v; expected ErrUpstreamFailed", results[4].Err)
+	}
+}
+
+func TestPlanRejectsCyclesAndMissingDeps(t *testing.T) {
+	g := New[int]()
+	g.Add(1, 0, 3)
+	g.Add(2, 0, 1)
+	g.Add(3, 0, 2)
+	g.Add(4, 0)
+	if _, err := g.Plan(); !errors.Is(err, ErrCycle) {
+		t.Errorf("Plan = %v; expected ErrCycle", err)
+	}
+
+	g = New[int]()
+	g.Add(1, 0, 7)
+	if _, err := g.Plan(); !errors.Is(err, ErrMissingDependency) {
+		t.Errorf("Plan = %v; expected ErrMissingDependency", err)
+	}
+
+	g = New[int]()
+	g.Add(1, 0)
+	g.Add(2, 0)
+	g.Add(3, 0, 1, 2)
+	stages, err := g.Plan()
+	if err != nil || fmt.Sprint(stages) != "[[1 2] [3]]" {
+		t.Errorf("Plan = %v, %v; expected [[1 2] [3]]", stages, err)
+	}
+
+	// Every stage keeps insertion order, not just the first
+	g = New[int]()
+	g.Add(5, 0)
+	g.Add(3, 0)
+	g.Add(4, 0, 5)
+	g.Add(2, 0, 3)
+	stages, err = g.Plan()
+	if err != nil || fmt.Sprint(stages) != "[[5 3] [4 2]]" {
+		t.Errorf("Plan = %v, %v; expected [[5 3] [4 2]]", stages, err)
+	}
+}
@@ -0,0 +1,349 @@
+// Package jobqueue is a durable job queue backed by an on-disk
+// write-ahead log.
+//
+// Every enqueue and ack is appended to a segment file before it takes
+// effect, so after a crash Open redelivers every job that was queued or in
+// flight but never acked. Dequeued jobs must be acked (done) or nacked
+// (try again); a job that is neither within the visibility timeout is
+// handed out again.
+//
+// Chan turns the queue into a plain channel, so it can feed a worker pool
+// anywhere a chan Task used to:
+//
+//	for msg := range q.Chan(ctx) {
+//		pool.Submit(ctx, msg.ID, msg.Payload)
+//	}
+//	...
+//	for res := range pool.Results() {
+//		if res.Err != nil {
+//			q.Nack(res.JobID)
+//		} else {
+//			q.Ack(res.JobID)
+//		}
+//	}
+package jobqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by operations on a closed queue
+	ErrClosed = errors.New("jobqueue: queue is closed")
+
+	// ErrUnknownJob is returned when acking or nacking an ID that is not
+	// queued or in flight
+	ErrUnknownJob = errors.New("jobqueue: unknown job")
+)
+
+// Options tunes a Queue
+type Options struct {
+	// SegmentSize is the size at which a new segment file is started
+	// (default 4 MiB)
+	SegmentSize int64
+
+	// Sync fsyncs after every record. Without it a crash can lose the last
+	// few records the OS had not flushed yet.
+	Sync bool
+
+	// VisibilityTimeout is how long a dequeued job may go without an ack
+	// before it is delivered again (default 30s)
+	VisibilityTimeout time.Duration
+}
+
+// Message is one job handed out by the queue
+type Message[T any] struct {
+	ID         int
+	Payload    T
+	Deliveries int  // how many times this job has been handed out
+	Recovered  bool // loaded from the log on Open rather than enqueued now
+}
+
+type entry[T any] struct {
+	msg      Message[T]
+	segment  int
+	inFlight bool
+	deadline time.Time
+}
+
+// Queue is a persistent FIFO of jobs of type T
+type Queue[T any] struct {
+	opts Options
+
+	mu     sync.Mutex
+	log    *segmentLog
+	nextID int
+	ready  []int // IDs waiting to be dequeued, oldest first
+	jobs   map[int]*entry[T]
+	closed bool
+
+	notify chan struct{} // signalled when ready gains an ID
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// Open opens or creates the queue stored in dir and recovers every job that
+// was not acked before the last shutdown
+func Open[T any](dir string, opts Options) (*Queue[T], error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 4 << 20
+	}
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 30 * time.Second
+	}
+
+	q := &Queue[T]{
+		opts:   opts,
+		jobs:   make(map[int]*entry[T]),
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	var replayErr error
+	log, err := openLog(dir, opts.SegmentSize, opts.Sync, func(seq int, rec record) (int, bool) {
+		q.nextID = max(q.nextID, rec.ID)
+		switch rec.Op {
+		case opEnqueue:
+			var payload T
+			if err := json.Unmarshal(rec.Payload, &payload); err != nil && replayErr == nil {
+				replayErr = err
+			}
+			q.jobs[rec.ID] = &entry[T]{
+				msg:     Message[T]{ID: rec.ID, Payload: payload, Recovered: true},
+				segment: seq,
+			}
+			q.ready = append(q.ready, rec.ID)
+		case opAck:
+			if e, ok := q.jobs[rec.ID]; ok {
+				delete(q.jobs, rec.ID)
+				return e.segment, true
+			}
+		}
+		return 0, false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if replayErr != nil {
+		log.close()
+		return nil, replayErr
+	}
+	q.log = log
+
+	// Drop acked IDs from the ready list built during replay
+	ready := q.ready[:0]
+	for _, id := range q.ready {
+		if _, ok := q.jobs[id]; ok {
+			ready = append(ready, id)
+		}
+	}
+	q.ready = ready
+	if len(q.ready) > 0 {
+		q.signal()
+	}
+
+	go q.reaper()
+	return q, nil
+}
+
+// Enqueue durably appends a job and returns its ID
+func (q *Queue[T]) Enqueue(payload T) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+	id := q.nextID + 1
+	seq, err := q.log.append(record{Op: opEnqueue, ID: id, Payload: body})
+	if err != nil {
+		return 0, err
+	}
+	q.nextID = id
+	q.jobs[id] = &entry[T]{msg: Message[T]{ID: id, Payload: payload}, segment: seq}
+	q.ready = append(q.ready, id)
+	q.signal()
+	return id, nil
+}
+
+// Dequeue blocks until a job is ready and marks it in flight
+func (q *Queue[T]) Dequeue(ctx context.Context) (Message[T], error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return Message[T]{}, ErrClosed
+		}
+		if len(q.ready) > 0 {
+			id := q.ready[0]
+			q.ready = q.ready[1:]
+			e := q.jobs[id]
+			e.inFlight = true
+			e.deadline = time.Now().Add(q.opts.VisibilityTimeout)
+			e.msg.Deliveries++
+			msg := e.msg
+			if len(q.ready) > 0 {
+				q.signal() // let the next waiter in
+			}
+			q.mu.Unlock()
+			return msg, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-q.quit:
+		case <-ctx.Done():
+			return Message[T]{}, ctx.Err()
+		}
+	}
+}
+
+// Ack marks a job as done; it will not be delivered again
+func (q *Queue[T]) Ack(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	e, ok := q.jobs[id]
+	if !ok {
+		return ErrUnknownJob
+	}
+	if _, err := q.log.append(record{Op: opAck, ID: id}); err != nil {
+		return err
+	}
+	delete(q.jobs, id)
+	if !e.inFlight {
+		q.removeReady(id)
+	}
+	return q.log.release(e.segment)
+}
+
+// Nack returns an in-flight job to the back of the queue right away
+func (q *Queue[T]) Nack(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	e, ok := q.jobs[id]
+	if !ok || !e.inFlight {
+		return ErrUnknownJob
+	}
+	e.inFlight = false
+	q.ready = append(q.ready, id)
+	q.signal()
+	return nil
+}
+
+// Len returns the number of jobs waiting to be dequeued
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ready)
+}
+
+// InFlight returns the number of dequeued jobs that are not acked yet
+func (q *Queue[T]) InFlight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs) - len(q.ready)
+}
+
+// Chan delivers jobs on a channel until ctx is cancelled or the queue is
+// closed. A job dequeued but not taken when ctx ends is nacked.
+func (q *Queue[T]) Chan(ctx context.Context) <-chan Message[T] {
+	out := make(chan Message[T])
+	go func() {
+		defer close(out)
+		for {
+			msg, err := q.Dequeue(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				q.Nack(msg.ID)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Close flushes the log and stops the queue. Unacked jobs are redelivered
+// the next time the queue is opened.
+func (q *Queue[T]) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrClosed
+	}
+	q.closed = true
+	close(q.quit)
+	q.mu.Unlock()
+
+	<-q.done
+	return q.log.close()
+}
+
+func (q *Queue[T]) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue[T]) removeReady(id int) {
+	for i, r := range q.ready {
+		if r == id {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			return
+		}
+	}
+}
+
+// reaper puts jobs whose visibility timeout expired back in the queue
+func (q *Queue[T]) reaper() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(max(q.opts.VisibilityTimeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.quit:
+			return
+		case now := <-ticker.C:
+			q.mu.Lock()
+			var expired []int
+			for id, e := range q.jobs {
+				if e.inFlight && now.After(e.deadline) {
+					e.inFlight = false
+					expired = append(expired, id)
+				}
+			}
+			sort.Ints(expired)
+			q.ready = append(q.ready, expired...)
+			if len(q.ready) > 0 {
+				q.signal()
+			}
+			q.mu.Unlock()
+		}
+	}
+}
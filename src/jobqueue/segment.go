@@ -0,0 +1,317 @@
+package jobqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCorrupt is returned when a sealed segment, or a record of the newest
+// segment that is not its last, fails its checksum
+var ErrCorrupt = errors.New("jobqueue: corrupt segment")
+
+// errBadLength is a record length no append could have written
+var errBadLength = errors.New("bad record length")
+
+const (
+	opEnqueue = "enq"
+	opAck     = "ack"
+	opMark    = "mark" // first record of a segment: highest ID issued so far
+
+	headerSize    = 8 // uint32 length + uint32 CRC-32 of the body
+	maxRecordSize = 64 << 20
+	segmentExt    = ".log"
+)
+
+// record is one entry of the write-ahead log
+type record struct {
+	Op      string          `json:"op"`
+	ID      int             `json:"id"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// segmentLog is an append-only log split into numbered segment files.
+// A segment is deleted once every job enqueued in it, and in all older
+// segments, has been acked.
+type segmentLog struct {
+	dir     string
+	maxSize int64
+	sync    bool
+
+	seqs   []int       // existing segments, oldest first
+	live   map[int]int // segment -> jobs enqueued there and not yet acked
+	active *os.File
+	size   int64
+
+	// highest job ID seen, written at the start of every new segment so
+	// it survives the deletion of the segments that issued it
+	highWater int
+}
+
+// replayFunc is called for every record found on open. For an ack it
+// returns the segment the acked job was enqueued in.
+type replayFunc func(seq int, rec record) (ackedSeq int, acked bool)
+
+// openLog replays every segment in dir through replay and opens a fresh
+// active segment after them
+func openLog(dir string, maxSize int64, sync bool, replay replayFunc) (*segmentLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &segmentLog{dir: dir, maxSize: maxSize, sync: sync, seqs: seqs, live: make(map[int]int)}
+	for i, seq := range seqs {
+		last := i == len(seqs)-1
+		if err := l.replaySegment(seq, last, replay); err != nil {
+			return nil, err
+		}
+	}
+
+	next := 1
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+	if err := l.roll(next); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func (l *segmentLog) path(seq int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%010d%s", seq, segmentExt))
+}
+
+// replaySegment reads one segment. A crash mid-append leaves part of the
+// last record of the newest segment behind, and nothing after it, so a bad
+// record there with no intact record after it is cut off. Anywhere else,
+// or with an impossible length, it means the log is damaged.
+func (l *segmentLog) replaySegment(seq int, last bool, replay replayFunc) error {
+	f, err := os.OpenFile(l.path(seq), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !last || errors.Is(err, errBadLength) || intactAfter(f, good) {
+				return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, l.path(seq), good, err)
+			}
+			return f.Truncate(good)
+		}
+		good += n
+		l.highWater = max(l.highWater, rec.ID)
+		if rec.Op == opEnqueue {
+			l.live[seq]++
+		}
+		if ackedSeq, ok := replay(seq, rec); ok {
+			l.live[ackedSeq]--
+		}
+	}
+}
+
+func readRecord(r io.Reader) (record, int64, error) {
+	var rec record
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return rec, 0, errors.New("short header")
+		}
+		return rec, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > maxRecordSize {
+		return rec, 0, errBadLength
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rec, 0, errors.New("short body")
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return rec, 0, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, int64(headerSize + len(body)), nil
+}
+
+// intactAfter reports whether a whole record with a valid checksum starts
+// anywhere after the bad record at offset. It reads the rest of the file,
+// which only happens when the segment is damaged.
+func intactAfter(f *os.File, offset int64) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return true // can't tell, so don't cut anything off
+	}
+	rest := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(rest, offset); err != nil {
+		return true
+	}
+	for i := 1; i+headerSize <= len(rest); i++ {
+		size := int(binary.BigEndian.Uint32(rest[i : i+4]))
+		end := i + headerSize + size
+		if size == 0 || size > maxRecordSize || end > len(rest) {
+			continue
+		}
+		body := rest[i+headerSize : end]
+		if crc32.ChecksumIEEE(body) == binary.BigEndian.Uint32(rest[i+4:i+8]) && json.Valid(body) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, headerSize+len(body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	copy(buf[headerSize:], body)
+	return buf, nil
+}
+
+// append writes rec to the active segment and returns the segment it
+// landed in
+func (l *segmentLog) append(rec record) (int, error) {
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	if l.size > 0 && l.size+int64(len(buf)) > l.maxSize {
+		if err := l.roll(l.activeSeq() + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := l.write(buf); err != nil {
+		return 0, err
+	}
+	l.highWater = max(l.highWater, rec.ID)
+
+	seq := l.activeSeq()
+	if rec.Op == opEnqueue {
+		l.live[seq]++
+	}
+	return seq, nil
+}
+
+func (l *segmentLog) write(buf []byte) error {
+	if _, err := l.active.Write(buf); err != nil {
+		return err
+	}
+	l.size += int64(len(buf))
+	if l.sync {
+		return l.active.Sync()
+	}
+	return nil
+}
+
+func (l *segmentLog) activeSeq() int {
+	return l.seqs[len(l.seqs)-1]
+}
+
+// roll seals the active segment and starts segment seq
+func (l *segmentLog) roll(seq int) error {
+	if l.active != nil {
+		if err := l.active.Sync(); err != nil {
+			return err
+		}
+		if err := l.active.Close(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.active = f
+	l.size = 0
+	if len(l.seqs) == 0 || l.seqs[len(l.seqs)-1] != seq {
+		l.seqs = append(l.seqs, seq)
+	}
+	if l.highWater > 0 {
+		buf, err := encodeRecord(record{Op: opMark, ID: l.highWater})
+		if err != nil {
+			return err
+		}
+		if err := l.write(buf); err != nil {
+			return err
+		}
+	}
+	return l.compact()
+}
+
+// release records that a job enqueued in segment seq was acked
+func (l *segmentLog) release(seq int) error {
+	l.live[seq]--
+	return l.compact()
+}
+
+// compact deletes the oldest sealed segments that no longer hold live jobs.
+// Only a prefix is removed so acks for older segments are never lost.
+func (l *segmentLog) compact() error {
+	for len(l.seqs) > 1 && l.live[l.seqs[0]] <= 0 {
+		seq := l.seqs[0]
+		if err := os.Remove(l.path(seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(l.live, seq)
+		l.seqs = l.seqs[1:]
+	}
+	return nil
+}
+
+func (l *segmentLog) close() error {
+	if err := l.active.Sync(); err != nil {
+		l.active.Close()
+		return err
+	}
+	return l.active.Close()
+}
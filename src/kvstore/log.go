@@ -0,0 +1,222 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrCorrupt is returned by Open when a snapshot, or a log record that is
+// not the last one, fails its checksum
+var ErrCorrupt = errors.New("kvstore: corrupt data")
+
+// errBadLength is a record length no append could have written
+var errBadLength = errors.New("bad record length")
+
+const (
+	opPut   = "put"
+	opDel   = "del"
+	opClear = "clear"
+	opEnd   = "end" // last record of a complete snapshot
+
+	headerSize    = 8 // uint32 length + uint32 CRC-32 of the body
+	maxRecordSize = 64 << 20
+
+	logFile      = "wal.log"
+	snapshotFile = "snapshot.db"
+)
+
+// record is one entry of the log or a snapshot
+type record struct {
+	Rev   uint64          `json:"rev"`
+	Op    string          `json:"op"`
+	Key   json.RawMessage `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, headerSize+len(body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	copy(buf[headerSize:], body)
+	return buf, nil
+}
+
+// readRecord returns the next record and its size on disk
+func readRecord(r io.Reader) (record, int64, error) {
+	var rec record
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return rec, 0, errors.New("short header")
+		}
+		return rec, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > maxRecordSize {
+		return rec, 0, errBadLength
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rec, 0, errors.New("short body")
+	}
+	if crc32.ChecksumIEEE(body) != sum {
+		return rec, 0, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, int64(headerSize + len(body)), nil
+}
+
+// readSnapshot calls apply for every record of the snapshot in dir and
+// returns its revision, or 0 if there is no snapshot. Snapshots are
+// renamed into place once complete, so any damage is corruption.
+func readSnapshot(dir string, apply func(record) error) (uint64, error) {
+	path := filepath.Join(dir, snapshotFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return 0, fmt.Errorf("%w: %s has no end record", ErrCorrupt, path)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, path, offset, err)
+		}
+		offset += n
+		if rec.Op == opEnd {
+			return rec.Rev, nil
+		}
+		if err := apply(rec); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// replayLog calls apply for every record of the log file f. A crash
+// mid-append leaves part of the last record behind, and nothing after
+// it, so a bad record with no intact record after it is cut off. One
+// with an impossible length or an intact record after it means the log
+// is damaged; it is reported and the file is left as it is.
+func replayLog(f *os.File, apply func(record) error) error {
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, errBadLength) || intactAfter(f, good) {
+				return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, f.Name(), good, err)
+			}
+			if err := f.Truncate(good); err != nil {
+				return err
+			}
+			_, err = f.Seek(good, io.SeekStart)
+			return err
+		}
+		good += n
+		if err := apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// intactAfter reports whether a whole record with a valid checksum starts
+// anywhere after the bad record at offset. It reads the rest of the file,
+// which only happens when the log is damaged.
+func intactAfter(f *os.File, offset int64) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return true // can't tell, so don't cut anything off
+	}
+	rest := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(rest, offset); err != nil {
+		return true
+	}
+	for i := 1; i+headerSize <= len(rest); i++ {
+		size := int(binary.BigEndian.Uint32(rest[i : i+4]))
+		end := i + headerSize + size
+		if size == 0 || size > maxRecordSize || end > len(rest) {
+			continue
+		}
+		body := rest[i+headerSize : end]
+		if crc32.ChecksumIEEE(body) == binary.BigEndian.Uint32(rest[i+4:i+8]) && json.Valid(body) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSnapshot atomically replaces the snapshot in dir with the records
+// produced by each, followed by an end record for rev
+func writeSnapshot(dir string, rev uint64, each func(emit func(record) error) error) error {
+	tmp, err := os.CreateTemp(dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	emit := func(rec record) error {
+		buf, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	}
+	err = each(emit)
+	if err == nil {
+		err = emit(record{Rev: rev, Op: opEnd})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,398 @@
+// Package kvstore is a SafeMap that survives restarts.
+//
+// Every mutation is appended to a write-ahead log before it is applied,
+// and Open replays the log to rebuild the map. So the log does not grow
+// forever, the whole map is written to a snapshot every so many records
+// and the log is emptied; records already covered by the snapshot are
+// skipped by revision on replay, so a crash at any point of a snapshot
+// loses nothing.
+//
+//	s, err := kvstore.Open[string, int](dir, kvstore.Options{})
+//	...
+//	defer s.Close()
+//	s.Set("worker_1_add", 1)
+//
+// Records carry a CRC-32. A torn record at the end of the log, which is
+// what a crash mid-append leaves behind, is cut off on Open; damage
+// anywhere else is reported as ErrCorrupt. Keys and values are stored as
+// JSON.
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"safemap"
+)
+
+// ErrClosed is returned by operations on a closed store
+var ErrClosed = errors.New("kvstore: store is closed")
+
+// SyncPolicy says when the log is fsynced
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // before every mutation returns (default)
+	SyncInterval                   // in the background every Options.SyncInterval
+	SyncNever                      // whenever the OS flushes
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// Options tunes a Store
+type Options struct {
+	// Sync trades durability for speed. With anything but SyncAlways a
+	// crash can lose the last mutations the OS had not flushed yet.
+	Sync SyncPolicy
+	// SyncInterval is how often SyncInterval fsyncs (default 1s)
+	SyncInterval time.Duration
+
+	// SnapshotEvery is how many log records trigger a snapshot in the
+	// background (default 10000, negative for never)
+	SnapshotEvery int
+}
+
+// Store is a persistent map safe for concurrent use. Reads go straight to
+// the in-memory map; mutations are written to the log one at a time.
+type Store[K comparable, V any] struct {
+	opts Options
+	dir  string
+	data *safemap.SafeMap[K, V]
+
+	// mu serialises mutations, so the log holds them in the order they
+	// were applied
+	mu     sync.Mutex
+	wal    *os.File
+	size   int64
+	rev    uint64
+	since  int  // records since the last snapshot
+	dirty  bool // written but not fsynced
+	closed bool
+	failed error   // set when the log may hold a record the map does not
+	errs   []error // from background syncs and snapshots
+
+	compact chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// Open opens or creates the store in dir and loads its contents
+func Open[K comparable, V any](dir string, opts Options) (*Store[K, V], error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.SnapshotEvery == 0 {
+		opts.SnapshotEvery = 10000
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Store[K, V]{
+		opts:    opts,
+		dir:     dir,
+		data:    safemap.New[K, V](),
+		compact: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	rev, err := readSnapshot(dir, s.apply)
+	if err != nil {
+		return nil, err
+	}
+	s.rev = rev
+
+	wal, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = replayLog(wal, func(rec record) error {
+		if rec.Rev <= s.rev {
+			return nil // already in the snapshot
+		}
+		s.rev = rec.Rev
+		s.since++
+		return s.apply(rec)
+	})
+	if err == nil {
+		var info os.FileInfo
+		info, err = wal.Stat()
+		if err == nil {
+			s.size = info.Size()
+		}
+	}
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	s.wal = wal
+
+	go s.background()
+	return s, nil
+}
+
+// apply replays one record into the map
+func (s *Store[K, V]) apply(rec record) error {
+	var key K
+	if rec.Op != opClear {
+		if err := json.Unmarshal(rec.Key, &key); err != nil {
+			return err
+		}
+	}
+	switch rec.Op {
+	case opPut:
+		var value V
+		if err := json.Unmarshal(rec.Value, &value); err != nil {
+			return err
+		}
+		s.data.Set(key, value)
+	case opDel:
+		s.data.Delete(key)
+	case opClear:
+		s.data.Clear()
+	}
+	return nil
+}
+
+// Get returns the value under key and whether there was one
+func (s *Store[K, V]) Get(key K) (V, bool) {
+	return s.data.Get(key)
+}
+
+// Len returns the number of keys
+func (s *Store[K, V]) Len() int {
+	return s.data.Len()
+}
+
+// Range calls fn for every key until it returns false, as SafeMap.Range
+func (s *Store[K, V]) Range(fn func(key K, value V) bool) {
+	s.data.Range(fn)
+}
+
+// Set durably stores value under key. If writing the log fails the
+// value is not stored; if only the fsync fails it may or may not survive
+// a restart, and the store refuses every later write.
+func (s *Store[K, V]) Set(key K, value V) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(key, value)
+}
+
+// Delete durably removes key
+func (s *Store[K, V]) Delete(key K) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Get(key); !ok {
+		return s.checkOpen()
+	}
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.write(record{Op: opDel, Key: k}, func() { s.data.Delete(key) })
+}
+
+// Update replaces the value under key with fn's result, as SafeMap.Update,
+// and logs the change
+func (s *Store[K, V]) Update(key K, fn func(old V, ok bool) (V, bool)) (V, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkOpen(); err != nil {
+		var zero V
+		return zero, false, err
+	}
+
+	old, ok := s.data.Get(key)
+	v, keep := fn(old, ok)
+	switch {
+	case keep:
+		return v, true, s.put(key, v)
+	case ok:
+		k, err := json.Marshal(key)
+		if err != nil {
+			return v, false, err
+		}
+		return v, false, s.write(record{Op: opDel, Key: k}, func() { s.data.Delete(key) })
+	}
+	return v, false, nil
+}
+
+// Clear durably removes every key
+func (s *Store[K, V]) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(record{Op: opClear}, s.data.Clear)
+}
+
+// put logs and applies a Set; the caller holds s.mu
+func (s *Store[K, V]) put(key K, value V) error {
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.write(record{Op: opPut, Key: k, Value: v}, func() { s.data.Set(key, value) })
+}
+
+func (s *Store[K, V]) checkOpen() error {
+	if s.closed {
+		return ErrClosed
+	}
+	return s.failed
+}
+
+// fail stops all further writes. After a failed fsync the OS may or may
+// not have kept the last record, so the log can no longer be trusted to
+// match the map, and reusing its revision could make replay skip a
+// later record. The caller holds s.mu.
+func (s *Store[K, V]) fail(err error) error {
+	s.failed = fmt.Errorf("kvstore: log unusable, reopen the store: %w", err)
+	return err
+}
+
+// write appends rec to the log and, once it is there, runs apply. The
+// caller holds s.mu.
+func (s *Store[K, V]) write(rec record, apply func()) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	rec.Rev = s.rev + 1
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(buf); err != nil {
+		// Cut off whatever part was written so the next record does
+		// not land after garbage
+		if terr := s.wal.Truncate(s.size); terr != nil {
+			return s.fail(errors.Join(err, terr))
+		}
+		return err
+	}
+	s.size += int64(len(buf))
+	if s.opts.Sync == SyncAlways {
+		if err := s.wal.Sync(); err != nil {
+			return s.fail(err)
+		}
+	} else {
+		s.dirty = true
+	}
+
+	s.rev = rec.Rev
+	apply()
+	s.since++
+	if s.opts.SnapshotEvery > 0 && s.since >= s.opts.SnapshotEvery {
+		select {
+		case s.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Snapshot writes the whole map to a new snapshot and empties the log.
+// Mutations wait while it runs.
+func (s *Store[K, V]) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	var encErr error
+	err := writeSnapshot(s.dir, s.rev, func(emit func(record) error) error {
+		s.data.Range(func(key K, value V) bool {
+			k, err := json.Marshal(key)
+			if err == nil {
+				var v []byte
+				if v, err = json.Marshal(value); err == nil {
+					err = emit(record{Rev: s.rev, Op: opPut, Key: k, Value: v})
+				}
+			}
+			encErr = err
+			return err == nil
+		})
+		return encErr
+	})
+	if err != nil {
+		return err
+	}
+
+	// Everything in the log is in the snapshot now. If emptying it fails
+	// the old records are skipped by revision on the next Open.
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.size, s.since, s.dirty = 0, 0, false
+	return nil
+}
+
+// Close flushes the log and closes the store. It returns any error from
+// background syncs or snapshots.
+func (s *Store[K, V]) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	close(s.quit)
+	s.mu.Unlock()
+
+	<-s.done
+	errs := append(s.errs, s.wal.Sync(), s.wal.Close())
+	return errors.Join(errs...)
+}
+
+// background fsyncs for SyncInterval and takes the snapshots that writes
+// ask for
+func (s *Store[K, V]) background() {
+	defer close(s.done)
+
+	var tick <-chan time.Time
+	if s.opts.Sync == SyncInterval {
+		ticker := time.NewTicker(s.opts.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-tick:
+			s.mu.Lock()
+			if s.dirty && s.checkOpen() == nil {
+				if err := s.wal.Sync(); err != nil {
+					s.errs = append(s.errs, s.fail(err))
+				}
+				s.dirty = false
+			}
+			s.mu.Unlock()
+		case <-s.compact:
+			if err := s.Snapshot(); err != nil && !errors.Is(err, ErrClosed) {
+				s.mu.Lock()
+				s.errs = append(s.errs, fmt.Errorf("kvstore: snapshot: %w", err))
+				s.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func contents(s *Store[string, int]) map[string]int {
+	m := make(map[string]int)
+	s.Range(func(k string, v int) bool {
+		m[k] = v
+		return true
+	})
+	return m
+}
+
+func TestRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open[string, int](dir, Options{Sync: SyncNever, SnapshotEvery: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				s.Set(fmt.Sprintf("worker_%d_%d", w, i), i)
+				s.Update("total", func(n int, _ bool) (int, bool) { return n + 1, true })
+			}
+		}()
+	}
+	wg.Wait()
+	s.Clear()
+	s.Set("a", 1)
+	s.Set("b", 2)
+	s.Delete("a")
+	s.Update("c", func(int, bool) (int, bool) { return 3, true })
+	s.Update("c", func(int, bool) (int, bool) { return 0, false })
+	want := contents(s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("x", 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set after Close: %v", err)
+	}
+
+	s, err = Open[string, int](dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := contents(s); fmt.Sprint(got) != fmt.Sprint(want) || len(got) != 1 {
+		t.Fatalf("recovered %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open[string, int](dir, Options{SnapshotEvery: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("key_%d", i%10), i)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, logFile)); info.Size() != 0 {
+		t.Fatalf("log is %d bytes after a snapshot", info.Size())
+	}
+	s.Set("after", 1)
+	s.Delete("key_0")
+	want := contents(s)
+	s.Close()
+
+	// A crash between writing a snapshot and emptying the log leaves
+	// records the snapshot already holds; they must not be applied twice
+	log, _ := os.ReadFile(filepath.Join(dir, logFile))
+	s, _ = Open[string, int](dir, Options{})
+	s.Snapshot()
+	s.Close()
+	os.WriteFile(filepath.Join(dir, logFile), log, 0o644)
+
+	s, err = Open[string, int](dir, Options{SnapshotEvery: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(s); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("recovered %v, want %v", got, want)
+	}
+	if s.rev != 102 {
+		t.Fatalf("revision %d, want 102", s.rev)
+	}
+
+	// Snapshots triggered in the background while writing lose nothing
+	for i := 0; i < 20; i++ {
+		s.Set("more", i)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = Open[string, int](dir, Options{})
+	defer s.Close()
+	if v, _ := s.Get("more"); v != 19 {
+		t.Fatalf("more = %d", v)
+	}
+}
+
+func TestTornAndCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, logFile)
+	s, err := Open[string, int](dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", 1)
+	s.Set("b", 2)
+	s.Close()
+	good, _ := os.ReadFile(path)
+
+	// Half of a record, as left by a crash mid-append, is dropped
+	rec, _ := encodeRecord(record{Rev: 3, Op: opPut, Key: []byte(`"c"`), Value: []byte(`3`)})
+	os.WriteFile(path, append(append([]byte{}, good...), rec[:len(rec)/2]...), 0o644)
+	s, err = Open[string, int](dir, Options{})
+	if err != nil {
+		t.Fatalf("torn tail: %v", err)
+	}
+	if got := contents(s); len(got) != 2 {
+		t.Fatalf("recovered %v", got)
+	}
+	s.Set("c", 3) // appends after the cut
+	s.Close()
+	s, _ = Open[string, int](dir, Options{})
+	if v, ok := s.Get("c"); !ok || v != 3 {
+		t.Fatalf("c = %d, %v after writing past a torn record", v, ok)
+	}
+	s.Close()
+
+	// So is a zeroed tail, which some filesystems show after a crash
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append(data, make([]byte, 100)...), 0o644)
+	s, err = Open[string, int](dir, Options{})
+	if err != nil || s.Len() != 3 {
+		t.Fatalf("zeroed tail: %v", err)
+	}
+	s.Close()
+
+	// A flipped byte in a record followed by more records is corruption,
+	// whether in the body or in the length, and the log is left alone
+	first := headerSize + int(binary.BigEndian.Uint32(data[0:4]))
+	for _, at := range []int{headerSize + 2, first + 1, first + 3} {
+		bad := append([]byte{}, data...)
+		bad[at] ^= 0x01
+		os.WriteFile(path, bad, 0o644)
+		if _, err := Open[string, int](dir, Options{}); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("byte %d flipped: err = %v, want ErrCorrupt", at, err)
+		}
+		if after, _ := os.ReadFile(path); len(after) != len(bad) {
+			t.Fatalf("byte %d flipped: log cut from %d to %d bytes", at, len(bad), len(after))
+		}
+	}
+}
+
+func TestFailedWriteStopsWrites(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open[string, int](dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", 1)
+
+	// Pull the file out from under the store: the write fails and so
+	// does cutting off what it may have left
+	s.wal.Close()
+	if err := s.Set("b", 2); err == nil {
+		t.Fatal("Set on a broken log succeeded")
+	}
+	if err := s.Set("c", 3); err == nil || s.rev != 1 {
+		t.Fatalf("later Set: err %v, revision %d; want an error and revision 1", err, s.rev)
+	}
+	if _, ok := s.Get("b"); ok {
+		t.Fatal("failed Set changed the map")
+	}
+	s.Close()
+
+	s, err = Open[string, int](dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := contents(s); len(got) != 1 || got["a"] != 1 {
+		t.Fatalf("recovered %v", got)
+	}
+}
@@ -1,62 +1,32 @@
 package main
 
 import (
+    "context"
     "fmt"
     "sync"
     "time"
+
+    "pipeline"
+    "workerpool"
 )
 
 // Example 1: Fan-out pattern with error handling
-func worker(id int, jobs <-chan int, results chan<- int, errors chan<- error) {
-    defer func() {
-        if r := recover(); r != nil {
-            errors <- fmt.Errorf("worker %d panicked: %v", id, r)
-        }
-    }()
-    
-    for job := range jobs {
-        if job%2 == 0 {
-            results <- job * 2
-        } else {
-            panic(fmt.Sprintf("odd number not allowed: %d", job))
-        }
+// Odd numbers panic; the pool recovers and reports them as job errors
+func doubleEven(ctx context.Context, id int, job int) (int, error) {
+    if job%2 != 0 {
+        panic(fmt.Sprintf("odd number not allowed: %d", job))
     }
+    return job * 2, nil
 }
 
 // Example 2: Pipeline with error handling
-type Result struct {
-    value int
-    err   error
-}
-
-func generator(nums ...int) <-chan Result {
-    out := make(chan Result)
-    go func() {
-        defer close(out)
-        for _, n := range nums {
-            out <- Result{value: n, err: nil}
-        }
-    }()
-    return out
-}
-
-func multiply(in <-chan Result) <-chan Result {
-    out := make(chan Result)
-    go func() {
-        defer close(out)
-        for res := range in {
-            if res.err != nil {
-                out <- res
-                continue
-            }
-            if res.value == 0 {
-                out <- Result{0, fmt.Errorf("cannot multiply zero")}
-                continue
-            }
-            out <- Result{value: res.value * 2, err: nil}
-        }
-    }()
-    return out
+// Zero cannot be multiplied; the pipeline's error strategy decides what
+// happens to it instead of every stage passing errors along by hand
+func multiply(ctx context.Context, n int) (int, error) {
+    if n == 0 {
+        return 0, fmt.Errorf("cannot multiply zero")
+    }
+    return n * 2, nil
 }
 
 // 1. Basic Channel Communication
@@ -198,26 +168,11 @@ func fanInExample() {
     fmt.Println("\n=== Fan-in Pattern ===")
     ch1 := make(chan string)
     ch2 := make(chan string)
-    merged := make(chan string)
     
-    // Merge channels
-    go func() {
-        var wg sync.WaitGroup
-        wg.Add(2)
-        
-        output := func(c <-chan string) {
-            defer wg.Done()
-            for msg := range c {
-                merged <- msg
-            }
-        }
-        
-        go output(ch1)
-        go output(ch2)
-        
-        wg.Wait()
-        close(merged)
-    }()
+    // Merge channels: any number of them, added whenever
+    merged := pipeline.NewMerger[string](context.Background())
+    merged.Add(ch1)
+    merged.Add(ch2)
     
     // Send data
     go func() {
@@ -232,8 +187,17 @@ func fanInExample() {
         close(ch2)
     }()
     
+    // Alerts jump the queue whenever they are ready
+    alerts := make(chan string, 1)
+    alerts <- "ALERT"
+    close(alerts)
+    merged.AddPriority(alerts, 1)
+    
+    // No more inputs: merged closes after the last one does
+    merged.Close()
+    
     // Receive merged data
-    for msg := range merged {
+    for msg := range merged.Out() {
         fmt.Printf("Received: %s\n", msg)
     }
 }
@@ -266,70 +230,91 @@ func pipelineExample() {
     }
 }
 
+// 9. Broadcast Pattern
+// Unlike fan-out, every consumer gets every item
+func broadcastExample() {
+    fmt.Println("\n=== Broadcast Pattern ===")
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    
+    prices := make(chan int)
+    b := pipeline.NewBroadcaster(ctx, prices)
+    
+    // The ledger must see everything, so the feed waits for it
+    ledger, _ := b.Subscribe(0, pipeline.Block)
+    // A dashboard can skip prices it is too slow for
+    dashboard, _ := b.Subscribe(1, pipeline.Drop)
+    // A mirror that falls behind is cut off and has to resync
+    mirror, _ := b.Subscribe(2, pipeline.Disconnect)
+    
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for price := range ledger.C {
+            fmt.Printf("Ledger: %d\n", price)
+        }
+    }()
+    
+    for price := 100; price < 105; price++ {
+        prices <- price
+    }
+    close(prices)
+    wg.Wait()
+    
+    for price := range dashboard.C {
+        fmt.Printf("Dashboard: %d (missed %d)\n", price, dashboard.Dropped())
+    }
+    for price := range mirror.C {
+        fmt.Printf("Mirror: %d\n", price)
+    }
+    fmt.Printf("Mirror: %v\n", mirror.Err())
+}
+
 func main() {
     fmt.Println("=== Fan-out Pattern Example ===")
-    jobs := make(chan int, 5)
-    results := make(chan int, 5)
-    errors := make(chan error, 5)
+    ctx := context.Background()
     
     // Start workers
-    var wg sync.WaitGroup
-    for w := 1; w <= 3; w++ {
-        wg.Add(1)
-        go func(id int) {
-            defer wg.Done()
-            worker(id, jobs, results, errors)
-        }(w)
-    }
+    pool := workerpool.New(ctx, 3, doubleEven,
+        workerpool.WithQueueSize(5),
+        workerpool.WithResultBuffer(5),
+    )
     
     // Send jobs
     go func() {
         for i := 0; i < 5; i++ {
-            jobs <- i
+            pool.Submit(ctx, i, i)
         }
-        close(jobs)
-    }()
-    
-    // Wait for workers in separate goroutine
-    go func() {
-        wg.Wait()
-        close(results)
-        close(errors)
+        pool.Close()
     }()
     
     // Collect results and errors
-    for {
-        select {
-        case res, ok := <-results:
-            if !ok {
-                results = nil
-                continue
-            }
-            fmt.Printf("Result: %d\n", res)
-        case err, ok := <-errors:
-            if !ok {
-                errors = nil
-                continue
-            }
-            fmt.Printf("Error: %v\n", err)
-        }
-        if results == nil && errors == nil {
-            break
+    for res := range pool.Results() {
+        if res.Err != nil {
+            fmt.Printf("Error: %v\n", res.Err)
+            continue
         }
+        fmt.Printf("Result: %d\n", res.Value)
     }
     
     fmt.Println("\n=== Pipeline Pattern Example ===")
+    // Failed items go to an error sink and the rest keep flowing
+    p := pipeline.New(ctx, pipeline.WithErrorStrategy(pipeline.RouteErrors(func(e *pipeline.ItemError) {
+        fmt.Printf("Pipeline error: %v\n", e.Err)
+    })))
+    
     // Create pipeline
-    numbers := generator(0, 1, 2, 3, 4)
-    doubled := multiply(numbers)
+    numbers := pipeline.FromSlice(p, 0, 1, 2, 3, 4)
+    doubled := pipeline.Map(p, "multiply", numbers, multiply)
     
     // Collect results
-    for res := range doubled {
-        if res.err != nil {
-            fmt.Printf("Pipeline error: %v\n", res.err)
-        } else {
-            fmt.Printf("Pipeline result: %d\n", res.value)
-        }
+    pipeline.Sink(p, "print", doubled, func(ctx context.Context, n int) error {
+        fmt.Printf("Pipeline result: %d\n", n)
+        return nil
+    })
+    if err := p.Wait(); err != nil {
+        fmt.Println(err)
     }
 
     basicChannelExample()
@@ -340,4 +325,5 @@ func main() {
     fanOutExample()
     fanInExample()
     pipelineExample()
+    broadcastExample()
 } 
\ No newline at end of file
@@ -1,127 +1,127 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
-    "sync"
     "time"
+
+    "pipeline"
+    "workerpool"
 )
 
 // Example 1: Fan-out/Fan-in Pattern
-func worker(id int, jobs <-chan int, results chan<- string) {
-    defer func() {
-        if r := recover(); r != nil {
-            results <- fmt.Sprintf("Worker %d error: %v", id, r)
-        }
-    }()
-    
-    for job := range jobs {
-        if job%3 == 0 {
-            panic(fmt.Sprintf("Worker %d: Can't process job %d", id, job))
-        }
-        results <- fmt.Sprintf("Worker %d processed job %d", id, job)
-        time.Sleep(100 * time.Millisecond)
+// Every third job panics on its first attempt and job 9 never succeeds.
+// The pool turns panics into errors, retries them and keeps the worker alive.
+func describeJob(ctx context.Context, id int, job int) (string, error) {
+    if job == 9 || (job%3 == 0 && workerpool.Attempt(ctx) == 1) {
+        panic(fmt.Sprintf("Worker %d: Can't process job %d", id, job))
     }
+    time.Sleep(100 * time.Millisecond)
+    return fmt.Sprintf("Worker %d processed job %d", id, job), nil
 }
 
 // Example 2: Pipeline Pattern
-type Data struct {
-    value int
-    err   error
-}
-
-func generator(done chan bool) <-chan Data {
-    out := make(chan Data)
-    go func() {
-        defer close(out)
-        for i := 1; i <= 5; i++ {
-            select {
-            case out <- Data{i, nil}:
-            case <-done:
-                return
-            }
+// Reading 3 is unreadable at the source and value 4 fails twice before
+// the processor gets it right
+func generator(ctx context.Context, emit func(pipeline.Item[int]) error) error {
+    for i := 1; i <= 5; i++ {
+        item := pipeline.Item[int]{Value: i}
+        if i == 3 {
+            item.Err = fmt.Errorf("reading %d is corrupt", i)
         }
-    }()
-    return out
+        if err := emit(item); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
-func processor(done chan bool, in <-chan Data) <-chan Data {
-    out := make(chan Data)
-    go func() {
-        defer close(out)
-        for data := range in {
-            if data.err != nil {
-                out <- data
-                continue
-            }
-            
-            select {
-            case out <- Data{data.value * 2, nil}:
-            case <-done:
-                return
-            }
+func processor(attempts map[int]int) func(ctx context.Context, value int) (int, error) {
+    return func(ctx context.Context, value int) (int, error) {
+        attempts[value]++
+        if value == 4 && attempts[value] < 3 {
+            return 0, fmt.Errorf("value %d: temporary failure", value)
         }
-    }()
-    return out
+        return value * 2, nil
+    }
 }
 
 func main() {
     fmt.Println("=== Fan-out/Fan-in Example ===")
-    jobs := make(chan int, 10)
-    results := make(chan string, 10)
+    ctx := context.Background()
     
     // Start workers
-    var wg sync.WaitGroup
-    for w := 1; w <= 3; w++ {
-        wg.Add(1)
-        go func(id int) {
-            defer wg.Done()
-            worker(id, jobs, results)
-        }(w)
-    }
+    pool := workerpool.New(ctx, 3, describeJob,
+        workerpool.WithQueueSize(10),
+        workerpool.WithResultBuffer(10),
+        workerpool.WithRetry(workerpool.RetryPolicy{
+            MaxAttempts: 3,
+            BaseDelay:   50 * time.Millisecond,
+            MaxDelay:    time.Second,
+            Jitter:      0.2,
+        }),
+        workerpool.WithDeadLetters(),
+    )
     
     // Send jobs
     go func() {
         for i := 1; i <= 9; i++ {
-            jobs <- i
+            pool.Submit(ctx, i, i)
         }
-        close(jobs)
-    }()
-    
-    // Wait and close results
-    go func() {
-        wg.Wait()
-        close(results)
+        pool.Close()
     }()
     
     // Collect results
-    for result := range results {
-        fmt.Println(result)
+    for result := range pool.Results() {
+        if result.Err != nil {
+            fmt.Printf("Worker %d error after %d attempts: %v\n", result.WorkerID, result.Attempts, result.Err)
+            continue
+        }
+        fmt.Printf("%s (attempt %d)\n", result.Value, result.Attempts)
+    }
+    
+    // Inspect jobs that ran out of retries and replay them once fixed
+    dead := pool.DeadLetters()
+    for _, dl := range dead.List() {
+        fmt.Printf("Dead letter: job %d failed %d times: %v\n", dl.Job.ID, dl.Attempts, dl.Err)
+    }
+    fixed := workerpool.New(ctx, 1, func(ctx context.Context, id int, job int) (string, error) {
+        return fmt.Sprintf("Worker %d replayed job %d", id, job), nil
+    }, workerpool.WithQueueSize(dead.Len()))
+    dead.Replay(ctx, fixed.SubmitJob)
+    fixed.Close()
+    for result := range fixed.Results() {
+        fmt.Println(result.Value)
     }
     
     fmt.Println("\n=== Pipeline Example ===")
-    done := make(chan bool)
-    defer close(done)
+    pctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+    defer cancel()
+    // Retry flaky items, then skip whatever still fails and report it
+    p := pipeline.New(pctx, pipeline.WithErrorStrategy(pipeline.Retry(workerpool.RetryPolicy{
+        MaxAttempts: 3,
+        BaseDelay:   10 * time.Millisecond,
+    }, pipeline.SkipAndCollect())))
     
     // Create pipeline
-    input := generator(done)
-    output := processor(done, input)
+    input := pipeline.Settle(p, "settle", pipeline.Source(p, "generator", generator))
+    output := pipeline.Map(p, "processor", input, processor(map[int]int{}))
     
-    // Collect results with timeout
-    timeout := time.After(2 * time.Second)
-    for {
-        select {
-        case data, ok := <-output:
-            if !ok {
-                return
-            }
-            if data.err != nil {
-                fmt.Printf("Error: %v\n", data.err)
-            } else {
-                fmt.Printf("Result: %d\n", data.value)
-            }
-        case <-timeout:
-            fmt.Println("Pipeline timeout")
-            return
+    // Collect results; the timeout cancels every stage
+    pipeline.Sink(p, "print", output, func(ctx context.Context, value int) error {
+        fmt.Printf("Result: %d\n", value)
+        return nil
+    })
+    err := p.Wait()
+    if errors.Is(err, context.DeadlineExceeded) {
+        fmt.Println("Pipeline timeout")
+    }
+    var report *pipeline.ErrorReport
+    if errors.As(err, &report) {
+        fmt.Println(report)
+        for _, e := range report.Items {
+            fmt.Printf("  %v (after %d attempts)\n", e, e.Attempts)
         }
     }
-} 
\ No newline at end of file
+}
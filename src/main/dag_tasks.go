@@ -0,0 +1,85 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "dag"
+)
+
+// Task is the fan-out Task with dependencies on other tasks
+type Task struct {
+    ID        int
+    Type      string    // "cpu", "io", or "network"
+    Duration  time.Duration
+    DependsOn []int
+}
+
+// Each task waits for its upstream tasks and builds on their output
+func runTask(ctx context.Context, task Task, upstream map[int]string) (string, error) {
+    fmt.Printf("Task %d (%s) starting with inputs from %v\n", task.ID, task.Type, task.DependsOn)
+    
+    select {
+    case <-time.After(task.Duration):
+    case <-ctx.Done():
+        return "", ctx.Err()
+    }
+    
+    if task.Type == "broken" {
+        return "", fmt.Errorf("task %d could not reach its service", task.ID)
+    }
+    
+    var inputs []string
+    for _, id := range task.DependsOn {
+        inputs = append(inputs, upstream[id])
+    }
+    return fmt.Sprintf("%s#%d(%s)", task.Type, task.ID, strings.Join(inputs, ",")), nil
+}
+
+func main() {
+    dryRun := flag.Bool("dry-run", false, "print the execution plan without running it")
+    flag.Parse()
+
+    tasks := []Task{
+        {ID: 1, Type: "io", Duration: 300 * time.Millisecond},
+        {ID: 2, Type: "network", Duration: 400 * time.Millisecond},
+        {ID: 3, Type: "cpu", Duration: 500 * time.Millisecond, DependsOn: []int{1}},
+        {ID: 4, Type: "cpu", Duration: 200 * time.Millisecond, DependsOn: []int{1, 2}},
+        {ID: 5, Type: "broken", Duration: 100 * time.Millisecond, DependsOn: []int{2}},
+        {ID: 6, Type: "io", Duration: 300 * time.Millisecond, DependsOn: []int{3, 4}},
+        {ID: 7, Type: "network", Duration: 200 * time.Millisecond, DependsOn: []int{5}},
+    }
+
+    // Build the graph from the tasks' declared dependencies
+    graph := dag.New[Task]()
+    for _, task := range tasks {
+        graph.Add(task.ID, task, task.DependsOn...)
+    }
+
+    if *dryRun {
+        if err := graph.PrintPlan(os.Stdout); err != nil {
+            fmt.Println("Invalid graph:", err)
+        }
+        return
+    }
+
+    startTime := time.Now()
+    results, err := dag.Run(context.Background(), graph, 3, runTask)
+    if err != nil {
+        fmt.Printf("\nRun finished with errors: %v\n", err)
+    }
+
+    fmt.Printf("\nResults after %v:\n", time.Since(startTime).Round(time.Millisecond))
+    for _, task := range tasks {
+        r := results[task.ID]
+        if r.Err != nil {
+            fmt.Printf("Task %d: %s (%v)\n", r.ID, r.Status, r.Err)
+        } else {
+            fmt.Printf("Task %d: %s -> %s\n", r.ID, r.Status, r.Output)
+        }
+    }
+}
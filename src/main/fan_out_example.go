@@ -1,9 +1,11 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "sync"
     "time"
+
+    "workerpool"
 )
 
 // Simulating work with different processing times
@@ -13,49 +15,33 @@ func processTask(id int, task int) int {
     return task * 2
 }
 
-// Worker function
-func worker(id int, tasks <-chan int, results chan<- int, wg *sync.WaitGroup) {
-    defer wg.Done()
-    
-    for task := range tasks {
-        fmt.Printf("Worker %d processing task %d\n", id, task)
-        result := processTask(id, task)
-        results <- result
-        fmt.Printf("Worker %d completed task %d\n", id, task)
-    }
-}
-
 func main() {
     numWorkers := 3
     numTasks := 10
-
-    // Create channels
-    tasks := make(chan int, numTasks)
-    results := make(chan int, numTasks)
+    ctx := context.Background()
 
     // Start multiple workers (Fan-out)
-    var wg sync.WaitGroup
-    for i := 1; i <= numWorkers; i++ {
-        wg.Add(1)
-        go worker(i, tasks, results, &wg)
-    }
+    pool := workerpool.New(ctx, numWorkers,
+        func(ctx context.Context, id int, task int) (int, error) {
+            fmt.Printf("Worker %d processing task %d\n", id, task)
+            result := processTask(id, task)
+            fmt.Printf("Worker %d completed task %d\n", id, task)
+            return result, nil
+        },
+        workerpool.WithQueueSize(numTasks),
+        workerpool.WithResultBuffer(numTasks),
+    )
 
     // Send tasks
     go func() {
         for i := 1; i <= numTasks; i++ {
-            tasks <- i
+            pool.Submit(ctx, i, i)
         }
-        close(tasks)
+        pool.Close()
     }()
 
-    // Wait for all workers to finish and close results
-    go func() {
-        wg.Wait()
-        close(results)
-    }()
-
-    // Collect results (Fan-in)
-    for result := range results {
-        fmt.Printf("Got result: %d\n", result)
+    // Collect results (Fan-in); closed once all workers finish
+    for result := range pool.Results() {
+        fmt.Printf("Got result: %d\n", result.Value)
     }
-} 
\ No newline at end of file
+}
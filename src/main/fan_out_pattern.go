@@ -1,9 +1,15 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "sync"
+    "os"
+    "path/filepath"
     "time"
+
+    "jobqueue"
+    "timeline"
+    "workerpool"
 )
 
 // Task represents work to be done
@@ -16,6 +22,7 @@ type Task struct {
 // Result represents processed task result
 type Result struct {
     TaskID    int
+    Type      string
     WorkerID  int
     StartTime time.Time
     EndTime   time.Time
@@ -23,106 +30,160 @@ type Result struct {
 }
 
 // Worker processes tasks in parallel
-func worker(id int, tasks <-chan Task, results chan<- Result, wg *sync.WaitGroup) {
-    defer wg.Done()
-
-    for task := range tasks {
-        // Record start time
-        startTime := time.Now()
-        
-        fmt.Printf("Worker %d started  task %d at %s\n", 
-            id, task.ID, startTime.Format("15:04:05.000"))
-        
-        // Simulate processing
-        time.Sleep(task.Duration)
-        
-        // Record completion
-        endTime := time.Now()
-        
-        results <- Result{
-            TaskID:    task.ID,
-            WorkerID:  id,
-            StartTime: startTime,
-            EndTime:   endTime,
-            Output:    fmt.Sprintf("%s Result for task %d", task.Type, task.ID),
-        }
-        
-        fmt.Printf("Worker %d finished task %d at %s\n", 
-            id, task.ID, endTime.Format("15:04:05.000"))
-    }
+func worker(ctx context.Context, id int, task Task) (Result, error) {
+    // Record start time
+    startTime := time.Now()
+    
+    fmt.Printf("Worker %d started  task %d at %s\n", 
+        id, task.ID, startTime.Format("15:04:05.000"))
+    
+    // Simulate processing
+    time.Sleep(task.Duration)
+    
+    // Record completion
+    endTime := time.Now()
+    
+    fmt.Printf("Worker %d finished task %d at %s\n", 
+        id, task.ID, endTime.Format("15:04:05.000"))
+    
+    return Result{
+        TaskID:    task.ID,
+        Type:      task.Type,
+        WorkerID:  id,
+        StartTime: startTime,
+        EndTime:   endTime,
+        Output:    fmt.Sprintf("%s Result for task %d", task.Type, task.ID),
+    }, nil
 }
 
 func main() {
-    // Create tasks with different durations
-    tasks := []Task{
-        {ID: 1, Type: "cpu", Duration: 500 * time.Millisecond},
-        {ID: 2, Type: "io", Duration: 300 * time.Millisecond},
-        {ID: 3, Type: "network", Duration: 400 * time.Millisecond},
-        {ID: 4, Type: "cpu", Duration: 500 * time.Millisecond},
-        {ID: 5, Type: "io", Duration: 300 * time.Millisecond},
-        {ID: 6, Type: "network", Duration: 400 * time.Millisecond},
+    // Task mix with different durations; sent in bursts to exercise the autoscaler
+    mix := []Task{
+        {Type: "cpu", Duration: 500 * time.Millisecond},
+        {Type: "io", Duration: 300 * time.Millisecond},
+        {Type: "network", Duration: 400 * time.Millisecond},
+    }
+    const bursts = 3
+    const burstSize = 12
+    
+    var tasks []Task
+    for i := 0; i < bursts*burstSize; i++ {
+        task := mix[i%len(mix)]
+        task.ID = i + 1
+        tasks = append(tasks, task)
     }
 
-    taskChan := make(chan Task, len(tasks))
-    resultChan := make(chan Result, len(tasks))
+    fmt.Printf("Starting processing at: %s\n", time.Now().Format("15:04:05.000"))
 
-    startTime := time.Now()
-    fmt.Printf("Starting processing at: %s\n", startTime.Format("15:04:05.000"))
+    // Workers grow with the backlog and shrink again when it drains
+    ctx := context.Background()
+    pool := workerpool.New(ctx, 1, worker,
+        workerpool.WithQueueSize(len(tasks)),
+        workerpool.WithResultBuffer(len(tasks)),
+        workerpool.WithAutoscale(workerpool.AutoscaleConfig{
+            Min:               1,
+            Max:               8,
+            Interval:          100 * time.Millisecond,
+            TargetLatency:     time.Second,
+            ScaleUpCooldown:   200 * time.Millisecond,
+            ScaleDownCooldown: 500 * time.Millisecond,
+            OnScale: func(e workerpool.ScaleEvent) {
+                fmt.Printf(">>> scale %d -> %d workers (backlog %d, in flight %d, avg %v)\n",
+                    e.From, e.To, e.Backlog, e.InFlight, e.AvgDuration.Round(time.Millisecond))
+            },
+        }),
+    )
 
-    // Start multiple workers
-    numWorkers := 3
-    var wg sync.WaitGroup
+    // Tasks live in an on-disk queue, so a crash doesn't lose them: the
+    // next run picks up whatever was queued or in flight but never acked
+    queue, err := jobqueue.Open[Task](filepath.Join(os.TempDir(), "fan_out_queue"),
+        jobqueue.Options{Sync: true, VisibilityTimeout: 5 * time.Second})
+    if err != nil {
+        fmt.Println("Error opening task queue:", err)
+        return
+    }
+    defer queue.Close()
 
-    // Launch workers in parallel
-    for i := 1; i <= numWorkers; i++ {
-        wg.Add(1)
-        go worker(i, taskChan, resultChan, &wg)  // Workers run concurrently
+    // Send tasks in bursts with a quiet gap between them, unless the last
+    // run left some behind
+    enqueued := make(chan struct{})
+    if pending := queue.Len(); pending > 0 {
+        fmt.Printf("Recovered %d unfinished tasks from the last run\n", pending)
+        close(enqueued)
+    } else {
+        go func() {
+            defer close(enqueued)
+            for i, task := range tasks {
+                if i > 0 && i%burstSize == 0 {
+                    time.Sleep(2 * time.Second)
+                }
+                queue.Enqueue(task)
+            }
+        }()
     }
 
-    // Send tasks
+    // Feed the pool from the queue; job IDs are queue IDs so results can
+    // be acked
+    feedCtx, stopFeed := context.WithCancel(ctx)
+    defer stopFeed()
     go func() {
-        for _, task := range tasks {
-            taskChan <- task
+        for msg := range queue.Chan(feedCtx) {
+            if err := pool.Submit(feedCtx, msg.ID, msg.Payload); err != nil {
+                queue.Nack(msg.ID)
+            }
         }
-        close(taskChan)
+        pool.Close()
     }()
 
-    // Wait for workers
-    go func() {
-        wg.Wait()
-        close(resultChan)
-    }()
-
-    // Collect and analyze results
+    // Collect and analyze results, acking each one, until every task
+    // has been sent and finished
     var results []Result
-    for result := range resultChan {
-        results = append(results, result)
+    for result := range pool.Results() {
+        if result.Err != nil {
+            queue.Nack(result.JobID)
+            continue
+        }
+        queue.Ack(result.JobID)
+        results = append(results, result.Value)
+        select {
+        case <-enqueued:
+            if queue.Len() == 0 && queue.InFlight() == 0 {
+                stopFeed()
+            }
+        default:
+        }
+    }
+
+    spans := make([]timeline.Span, 0, len(results))
+    for _, r := range results {
+        spans = append(spans, timeline.Span{
+            Worker: r.WorkerID,
+            Task:   r.TaskID,
+            Name:   r.Type,
+            Start:  r.StartTime,
+            End:    r.EndTime,
+        })
     }
 
     // Show parallel execution evidence
     fmt.Println("\nParallel Execution Analysis:")
-    fmt.Printf("Total tasks: %d\n", len(tasks))
-    fmt.Printf("Number of workers: %d\n", numWorkers)
-    
-    // Calculate total sequential time vs actual time
-    totalSequentialTime := time.Duration(0)
-    for _, task := range tasks {
-        totalSequentialTime += task.Duration
-    }
-    
-    actualTime := time.Since(startTime)
-    
-    fmt.Printf("\nSequential would take: %v\n", totalSequentialTime)
-    fmt.Printf("Actual parallel time: %v\n", actualTime)
-    fmt.Printf("Speed improvement: %.2fx\n", 
-        float64(totalSequentialTime)/float64(actualTime))
+    fmt.Printf("Total tasks: %d\n", len(results))
+    timeline.Analyze(spans).Print(os.Stdout)
 
-    // Show overlapping executions
     fmt.Println("\nTask Execution Timeline:")
-    for _, r := range results {
-        fmt.Printf("Worker %d: Task %d - Start: %s, End: %s\n",
-            r.WorkerID, r.TaskID,
-            r.StartTime.Format("15:04:05.000"),
-            r.EndTime.Format("15:04:05.000"))
+    timeline.WriteGantt(os.Stdout, spans, 72)
+
+    // Full detail for chrome://tracing or https://ui.perfetto.dev
+    tracePath := filepath.Join(os.TempDir(), "fan_out_trace.json")
+    f, err := os.Create(tracePath)
+    if err != nil {
+        fmt.Println("Error writing trace:", err)
+        return
+    }
+    defer f.Close()
+    if err := timeline.WriteChromeTrace(f, spans); err != nil {
+        fmt.Println("Error writing trace:", err)
+        return
     }
-} 
\ No newline at end of file
+    fmt.Printf("\nChrome trace written to %s\n", tracePath)
+}
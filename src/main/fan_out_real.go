@@ -1,15 +1,17 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "sync"
     "time"
+
+    "workerpool"
 )
 
 type ImageTask struct {
     ID       int
     Size     int
-    Priority int
+    Priority int // higher runs first
 }
 
 func processImage(task ImageTask) string {
@@ -18,29 +20,22 @@ func processImage(task ImageTask) string {
     return fmt.Sprintf("Processed image %d (size: %d)", task.ID, task.Size)
 }
 
-func imageWorker(id int, tasks <-chan ImageTask, results chan<- string, wg *sync.WaitGroup) {
-    defer wg.Done()
-    
-    for task := range tasks {
-        fmt.Printf("Worker %d starting image %d\n", id, task.ID)
-        result := processImage(task)
-        results <- result
-    }
+func imageWorker(ctx context.Context, id int, task ImageTask) (string, error) {
+    fmt.Printf("Worker %d starting image %d (priority %d)\n", id, task.ID, task.Priority)
+    return processImage(task), nil
 }
 
 func main() {
-    tasks := make(chan ImageTask, 10)
-    results := make(chan string, 10)
+    ctx := context.Background()
     
-    // Start worker pool
+    // Start worker pool; queue size 0 so the dispatcher decides what runs next
     numWorkers := 3
-    var wg sync.WaitGroup
+    pool := workerpool.New(ctx, numWorkers, imageWorker, workerpool.WithResultBuffer(10))
     
-    // Fan out to workers
-    for i := 1; i <= numWorkers; i++ {
-        wg.Add(1)
-        go imageWorker(i, tasks, results, &wg)
-    }
+    // Priority dispatcher in front of the pool; waiting tasks gain one
+    // priority level every second so low-priority images still get done
+    dispatcher := workerpool.NewDispatcher[ImageTask](ctx, pool,
+        func(t ImageTask) int { return t.Priority }, time.Second)
     
     // Send image processing tasks
     go func() {
@@ -50,19 +45,19 @@ func main() {
                 Size:     i * 100,
                 Priority: i % 3,
             }
-            tasks <- task
+            dispatcher.Submit(ctx, task.ID, task)
         }
-        close(tasks)
-    }()
-    
-    // Wait and close results
-    go func() {
-        wg.Wait()
-        close(results)
+        dispatcher.Close()
     }()
     
     // Collect results
-    for result := range results {
-        fmt.Println(result)
+    for result := range pool.Results() {
+        fmt.Println(result.Value)
     }
-} 
\ No newline at end of file
+    
+    fmt.Println("\nQueue wait by priority:")
+    for _, s := range dispatcher.Stats() {
+        fmt.Printf("priority %d: %d tasks, mean %v, max %v\n",
+            s.Priority, s.Count, s.Mean.Round(time.Millisecond), s.Max.Round(time.Millisecond))
+    }
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"runtime"
-	"sync"
 	"time"
+
+	"workerpool"
 )
 
 func say(s string) {
@@ -53,12 +55,23 @@ func bufferExample(ch chan int) {
 }
 
 // Example 3: Worker Pool Pattern
-func worker(id int, jobs <-chan int, results chan<- int, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for job := range jobs {
+func workerPoolExample(numJobs int) {
+	ctx := context.Background()
+	pool := workerpool.New(ctx, 3, func(ctx context.Context, id int, job int) (int, error) {
 		fmt.Printf("Worker %d processing job %d\n", id, job)
 		time.Sleep(200 * time.Millisecond) // Simulate work
-		results <- job * 2
+		return job * 2, nil
+	}, workerpool.WithQueueSize(numJobs))
+
+	go func() {
+		for j := 1; j <= numJobs; j++ {
+			pool.Submit(ctx, j, j)
+		}
+		pool.Close()
+	}()
+
+	for result := range pool.Results() {
+		fmt.Printf("Job %d -> %d\n", result.JobID, result.Value)
 	}
 }
 
@@ -1,39 +1,20 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "os"
+    "path/filepath"
     "sync"
     "time"
-)
-
-// Thread-safe map wrapper
-type SafeMap struct {
-    sync.RWMutex
-    data map[string]int
-}
-
-// SafeMap methods
-func (sm *SafeMap) Set(key string, value int) {
-    sm.Lock()
-    defer sm.Unlock()
-    sm.data[key] = value
-}
-
-func (sm *SafeMap) Get(key string) (int, bool) {
-    sm.RLock()
-    defer sm.RUnlock()
-    val, exists := sm.data[key]
-    return val, exists
-}
 
-func (sm *SafeMap) Delete(key string) {
-    sm.Lock()
-    defer sm.Unlock()
-    delete(sm.data, key)
-}
+    "cache"
+    "kvstore"
+    "safemap"
+)
 
 // Worker that processes map operations
-func mapWorker(id int, sm *SafeMap, ops chan string, results chan string, done chan bool) {
+func mapWorker(id int, sm *safemap.SafeMap[string, int], ops chan string, results chan string, done chan bool) {
     defer func() {
         if r := recover(); r != nil {
             fmt.Printf("Worker %d recovered from: %v\n", id, r)
@@ -48,6 +29,11 @@ func mapWorker(id int, sm *SafeMap, ops chan string, results chan string, done c
             }
             // Process operation
             sm.Set(fmt.Sprintf("worker_%d_%s", id, op), id)
+            // Count it under one lock; a Get followed by a Set would race
+            // with the other workers
+            sm.Update("processed_"+op, func(n int, _ bool) (int, bool) {
+                return n + 1, true
+            })
             results <- fmt.Sprintf("Worker %d processed %s", id, op)
             
         case <-done:
@@ -63,10 +49,20 @@ func mapWorker(id int, sm *SafeMap, ops chan string, results chan string, done c
 
 // Demonstrates different map scenarios
 func demonstrateMapScenarios() {
-    // Initialize safe map
-    sm := &SafeMap{
-        data: make(map[string]int),
-    }
+    // Initialize safe map: sharded, so workers writing different keys
+    // don't queue on one lock
+    sm := safemap.New[string, int]()
+
+    // Report the per-operation counts as they change instead of polling
+    ctx, stopWatch := context.WithCancel(context.Background())
+    counts := sm.WatchPrefix(ctx, "processed_")
+    watched := make(chan struct{})
+    go func() {
+        defer close(watched)
+        for e := range counts.C {
+            fmt.Printf("Watch: %s %s %d -> %d (rev %d)\n", e.Type, e.Key, e.Old, e.New, e.Rev)
+        }
+    }()
 
     // Channels for coordination
     ops := make(chan string, 10)
@@ -114,14 +110,68 @@ func demonstrateMapScenarios() {
     // Wait for all workers
     wg.Wait()
     close(results)
+    stopWatch()
+    <-watched
 
     // Print final map state
     fmt.Println("\nFinal map state:")
-    sm.Lock()
-    defer sm.Unlock()
-    for k, v := range sm.data {
+    sm.Range(func(k string, v int) bool {
         fmt.Printf("%s: %d\n", k, v)
+        return true
+    })
+}
+
+// Demonstrates a bounded cache whose entries expire
+func demonstrateCache() {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel() // stops the janitor
+
+    c := cache.New(ctx, cache.Options[string, int]{
+        MaxEntries:      3,
+        DefaultTTL:      200 * time.Millisecond,
+        JanitorInterval: 50 * time.Millisecond,
+        OnEvict: func(key string, value int, reason cache.Reason) {
+            fmt.Printf("Removed %s=%d (%s)\n", key, value, reason)
+        },
+    })
+
+    for i, op := range []string{"add", "update", "delete"} {
+        c.Set("result_"+op, i)
+    }
+    c.Get("result_add") // now the most recently used
+    c.Set("result_merge", 3) // full: result_update goes
+
+    if v, ok := c.Get("result_add"); ok {
+        fmt.Println("Cached result_add:", v)
+    }
+    time.Sleep(300 * time.Millisecond) // the janitor removes the rest
+    if _, ok := c.Get("result_add"); !ok {
+        fmt.Println("result_add has expired")
+    }
+
+    s := c.Stats()
+    fmt.Printf("Hits: %d, misses: %d, evictions: %d, expirations: %d\n",
+        s.Hits, s.Misses, s.Evictions, s.Expirations)
+}
+
+// Demonstrates a map that keeps its contents across runs
+func demonstrateDurableMap() {
+    store, err := kvstore.Open[string, int](filepath.Join(os.TempDir(), "map_scenarios_store"), kvstore.Options{})
+    if err != nil {
+        fmt.Println("Error opening store:", err)
+        return
     }
+    defer store.Close()
+
+    // Run this program again and the count carries on
+    runs, _, err := store.Update("runs", func(n int, _ bool) (int, bool) {
+        return n + 1, true
+    })
+    if err != nil {
+        fmt.Println("Error updating store:", err)
+        return
+    }
+    fmt.Printf("This example has run %d times\n", runs)
 }
 
 // Demonstrates select with multiple channels
@@ -177,6 +227,12 @@ func main() {
     fmt.Println("=== Map with Goroutines Example ===")
     demonstrateMapScenarios()
 
+    fmt.Println("\n=== Expiring Cache Example ===")
+    demonstrateCache()
+
+    fmt.Println("\n=== Durable Map Example ===")
+    demonstrateDurableMap()
+
     fmt.Println("\n=== Select Pattern Example ===")
     demonstrateSelect()
 } 
\ No newline at end of file
@@ -1,70 +1,72 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "os"
     "time"
+
+    "pipeline"
 )
 
 // Stage 1: Generate numbers
-func generateNumbers() <-chan int {
-    out := make(chan int)
-    go func() {
-        defer close(out)
-        // Generate numbers 1 to 5
-        for i := 1; i <= 5; i++ {
-            fmt.Printf("Generating: %d\n", i)
-            out <- i
-            time.Sleep(100 * time.Millisecond)
+func generateNumbers(ctx context.Context, emit func(int) error) error {
+    // Generate numbers 1 to 5
+    for i := 1; i <= 5; i++ {
+        fmt.Printf("Generating: %d\n", i)
+        if err := emit(i); err != nil {
+            return err
         }
-    }()
-    return out
+        time.Sleep(100 * time.Millisecond)
+    }
+    return nil
 }
 
-// Stage 2: Double the numbers
-func doubleNumbers(in <-chan int) <-chan int {
-    out := make(chan int)
-    go func() {
-        defer close(out)
-        for num := range in {
-            result := num * 2
-            fmt.Printf("Doubling: %d -> %d\n", num, result)
-            out <- result
-            time.Sleep(100 * time.Millisecond)
-        }
-    }()
-    return out
+// Stage 2: Double the numbers (slow, so it runs on several goroutines)
+func doubleNumbers(ctx context.Context, num int) (int, error) {
+    result := num * 2
+    time.Sleep(time.Duration(6-num) * 50 * time.Millisecond)
+    fmt.Printf("Doubling: %d -> %d\n", num, result)
+    return result, nil
 }
 
 // Stage 3: Filter even numbers
-func filterEven(in <-chan int) <-chan int {
-    out := make(chan int)
-    go func() {
-        defer close(out)
-        for num := range in {
-            if num%2 == 0 {
-                fmt.Printf("Filtering: keeping %d\n", num)
-                out <- num
-            } else {
-                fmt.Printf("Filtering: dropping %d\n", num)
-            }
-            time.Sleep(100 * time.Millisecond)
-        }
-    }()
-    return out
+func filterEven(num int) bool {
+    if num%2 == 0 {
+        fmt.Printf("Filtering: keeping %d\n", num)
+    } else {
+        fmt.Printf("Filtering: dropping %d\n", num)
+    }
+    time.Sleep(100 * time.Millisecond)
+    return num%2 == 0
 }
 
 func main() {
     fmt.Println("Starting Pipeline Example")
-    
+
+    // Cancelling ctx (or any stage failing) shuts every stage down
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    p := pipeline.New(ctx)
+
     // Create the pipeline
-    numbers := generateNumbers()           // Stage 1
-    doubled := doubleNumbers(numbers)      // Stage 2
-    filtered := filterEven(doubled)        // Stage 3
-    
+    numbers := pipeline.Source(p, "generate", generateNumbers)                 // Stage 1
+    doubled := pipeline.ParallelMap(p, "double", numbers, 3, 2, doubleNumbers) // Stage 2: 3 at a time, still in order
+    filtered := pipeline.Filter(p, "filter", doubled, filterEven)              // Stage 3
+
     // Collect results
-    for result := range filtered {
+    pipeline.Sink(p, "print", filtered, func(ctx context.Context, result int) error {
         fmt.Printf("Got result: %d\n", result)
+        return nil
+    })
+
+    if err := p.Wait(); err != nil {
+        fmt.Println("Pipeline failed:", err)
+        return
     }
-    
     fmt.Println("Pipeline Complete")
-} 
\ No newline at end of file
+
+    // Where did the time go?
+    fmt.Println()
+    pipeline.AnalyzeStats(p.Stats()).Print(os.Stdout)
+}
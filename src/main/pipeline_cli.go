@@ -0,0 +1,153 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "os/signal"
+    "strings"
+    "time"
+
+    "pipeline"
+    "pipeline/spec"
+)
+
+// Stage types a pipeline file can use
+func stageRegistry() *spec.Registry {
+    reg := spec.NewRegistry()
+
+    // range: emits the numbers from..to, one every interval
+    reg.Register("range", func(params spec.Params) (spec.Stage, error) {
+        from, err := params.Int("from", 1)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        to, err := params.Int("to", 10)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        interval, err := params.Duration("interval", 0)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        return spec.Source(func(ctx context.Context, emit func(any) error) error {
+            for i := from; i <= to; i++ {
+                if err := emit(i); err != nil {
+                    return err
+                }
+                select {
+                case <-time.After(interval):
+                case <-ctx.Done():
+                    return ctx.Err()
+                }
+            }
+            return nil
+        }), nil
+    })
+
+    // multiply: multiplies by `by`, failing on multiples of fail_on and on
+    // anything that is not a number, such as the batches of a batch stage
+    reg.Register("multiply", func(params spec.Params) (spec.Stage, error) {
+        by, err := params.Int("by", 2)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        failOn, err := params.Int("fail_on", 0)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        delay, err := params.Duration("delay", 0)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        return spec.Map(func(ctx context.Context, item any) (any, error) {
+            n, ok := item.(int)
+            if !ok {
+                return nil, fmt.Errorf("multiply needs a number, got %T", item)
+            }
+            time.Sleep(delay)
+            if failOn != 0 && n%failOn == 0 {
+                return nil, fmt.Errorf("refusing to multiply %d", n)
+            }
+            return n * by, nil
+        }), nil
+    })
+
+    // divisible: keeps numbers divisible by `by` and drops anything else
+    reg.Register("divisible", func(params spec.Params) (spec.Stage, error) {
+        by, err := params.Int("by", 2)
+        if err != nil {
+            return spec.Stage{}, err
+        }
+        if by == 0 {
+            return spec.Stage{}, errors.New("by must not be zero")
+        }
+        return spec.Filter(func(item any) bool {
+            n, ok := item.(int)
+            return ok && n%by == 0
+        }), nil
+    })
+
+    // print: writes every item with an optional prefix
+    reg.Register("print", func(params spec.Params) (spec.Stage, error) {
+        prefix, err := params.String("prefix", "")
+        return spec.Sink(func(ctx context.Context, item any) error {
+            fmt.Printf("%s%v\n", prefix, item)
+            return nil
+        }), err
+    })
+
+    reg.RegisterErrorSink("stderr", func(e *pipeline.ItemError) {
+        fmt.Fprintf(os.Stderr, "error: %v\n", e)
+    })
+    return reg
+}
+
+func usage() {
+    fmt.Fprintln(os.Stderr, "usage: go run pipeline_cli.go validate|plan|run FILE")
+    fmt.Fprintln(os.Stderr, "  e.g. go run pipeline_cli.go plan pipelines/numbers.yaml")
+    os.Exit(2)
+}
+
+func main() {
+    flag.Usage = usage
+    flag.Parse()
+    if flag.NArg() != 2 {
+        usage()
+    }
+    command, path := flag.Arg(0), flag.Arg(1)
+
+    doc, err := spec.Load(path)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    reg := stageRegistry()
+
+    switch command {
+    case "validate":
+        err = doc.Validate(reg)
+        if err == nil {
+            fmt.Printf("%s: ok (%d stages)\n", path, len(doc.Stages))
+        }
+    case "plan":
+        err = doc.PrintPlan(os.Stdout, reg)
+    case "run":
+        // Ctrl-C cancels every stage
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        start := time.Now()
+        err = doc.Run(ctx, reg)
+        fmt.Printf("finished in %v\n", time.Since(start).Round(time.Millisecond))
+    default:
+        usage()
+    }
+
+    if err != nil {
+        // Validation problems come one per line
+        fmt.Fprintln(os.Stderr, strings.ReplaceAll(err.Error(), "\n", "\n  "))
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strconv"
+    "time"
+
+    "pipeline"
+)
+
+// Order is one line of the input feed
+type Order struct {
+    ID     int
+    Amount int
+}
+
+// Total is an order with the revenue so far
+type Total struct {
+    Order   Order
+    Revenue int
+}
+
+// Run it, kill it part way (Ctrl-C or -crash-after), run it again: it picks
+// up from the last checkpoint and the output file has every order once.
+func main() {
+    dir := flag.String("dir", filepath.Join(os.TempDir(), "resumable_pipeline"), "checkpoint directory")
+    crashAfter := flag.Int("crash-after", 0, "exit without cleanup after writing this many orders")
+    reset := flag.Bool("reset", false, "forget earlier runs and start over")
+    flag.Parse()
+
+    cp, err := pipeline.OpenCheckpoints(*dir)
+    if err != nil {
+        fmt.Println("Opening checkpoints:", err)
+        os.Exit(1)
+    }
+    outPath := filepath.Join(*dir, "orders.out")
+    if *reset {
+        if err := cp.Reset(); err != nil {
+            fmt.Println("Reset:", err)
+            os.Exit(1)
+        }
+        os.Remove(outPath)
+    }
+    if saved := cp.Saved(); !saved.IsZero() {
+        fmt.Println("Resuming from checkpoint taken at", saved.Format("15:04:05.000"))
+    }
+
+    output, err := os.OpenFile(outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+    if err != nil {
+        fmt.Println("Opening output:", err)
+        os.Exit(1)
+    }
+    defer output.Close()
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    p := pipeline.New(ctx, pipeline.WithCheckpoints(cp, 100*time.Millisecond))
+
+    // The offset says how many orders earlier runs already read
+    orders := pipeline.ResumableSource(p, "orders", func(ctx context.Context, offset int64, emit func(Order) error) error {
+        if offset > 0 {
+            fmt.Printf("Skipping %d orders read before\n", offset)
+        }
+        for id := int(offset) + 1; id <= 200; id++ {
+            if err := emit(Order{ID: id, Amount: id % 17 * 5}); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+
+    // The running revenue is stage state and is restored with the offset
+    totals := pipeline.StatefulMap(p, "revenue", orders, func(ctx context.Context, revenue *int, o Order) (Total, error) {
+        *revenue += o.Amount
+        return Total{Order: o, Revenue: *revenue}, nil
+    })
+
+    written := 0
+    pipeline.DedupeSink(p, "write", totals, func(t Total) string { return strconv.Itoa(t.Order.ID) },
+        func(ctx context.Context, t Total) error {
+            if written == *crashAfter && written > 0 {
+                fmt.Printf("Crashing after %d orders\n", written)
+                os.Exit(1)
+            }
+            time.Sleep(5 * time.Millisecond) // a slow downstream system
+            if _, err := fmt.Fprintf(output, "order %3d amount %3d revenue %5d\n", t.Order.ID, t.Order.Amount, t.Revenue); err != nil {
+                return err
+            }
+            written++
+            return nil
+        })
+
+    if err := p.Wait(); err != nil {
+        fmt.Println("Stopped:", err)
+        fmt.Println("Run again to resume")
+        return
+    }
+    fmt.Printf("Done: wrote %d orders this run, output in %s\n", written, outPath)
+}
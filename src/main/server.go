@@ -1,16 +1,103 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "math/rand"
     "net/http"
+    "time"
+
+    "metrics"
+    "workerpool"
 )
 
 func handler(w http.ResponseWriter, r *http.Request) {
     fmt.Fprintf(w, "Hello, %s!", r.URL.Path[1:])
 }
 
+// Keep a worker pool busy so /metrics has something to show
+func runPool(ctx context.Context, reg *metrics.Registry) {
+    pool := workerpool.New(ctx, 3, func(ctx context.Context, workerID int, n int) (int, error) {
+        time.Sleep(time.Duration(rand.Intn(200)) * time.Millisecond)
+        if n%25 == 0 {
+            panic(fmt.Sprintf("job %d is cursed", n))
+        }
+        return n * n, nil
+    },
+        workerpool.WithQueueSize(10),
+        workerpool.WithResultBuffer(5),
+        workerpool.WithOverflowPolicy(workerpool.DropOldest),
+        workerpool.WithMetrics(reg, "squares"),
+    )
+
+    go func() {
+        for n := 1; ctx.Err() == nil; n++ {
+            pool.Submit(ctx, n, n)
+            time.Sleep(40 * time.Millisecond)
+        }
+        pool.Close()
+    }()
+
+    // A slow consumer, so some results get dropped
+    for range pool.Results() {
+        time.Sleep(100 * time.Millisecond)
+    }
+}
+
+// Generate -> double -> keep multiples of 4, each stage instrumented
+func runPipeline(ctx context.Context, reg *metrics.Registry) {
+    gen := reg.Stage("numbers", "generate")
+    double := reg.Stage("numbers", "double")
+    filter := reg.Stage("numbers", "filter")
+
+    numbers := make(chan int, 10)
+    go func() {
+        defer close(numbers)
+        for i := 1; ; i++ {
+            select {
+            case numbers <- i:
+                gen.Out.Inc()
+            case <-ctx.Done():
+                return
+            }
+            time.Sleep(50 * time.Millisecond)
+        }
+    }()
+    reg.GaugeFunc("pipeline_stage_queue_depth", "Items buffered in front of a pipeline stage.",
+        metrics.Labels{"pipeline": "numbers", "stage": "double"},
+        func() float64 { return float64(len(numbers)) })
+
+    doubled := make(chan int)
+    go func() {
+        defer close(doubled)
+        for n := range numbers {
+            double.In.Inc()
+            start := time.Now()
+            time.Sleep(time.Duration(rand.Intn(80)) * time.Millisecond)
+            double.Observe(start)
+            doubled <- n * 2
+            double.Out.Inc()
+        }
+    }()
+
+    for n := range doubled {
+        filter.In.Inc()
+        if n%4 != 0 {
+            filter.Dropped.Inc()
+            continue
+        }
+        filter.Out.Inc()
+    }
+}
+
 func main() {
+    reg := metrics.NewRegistry()
+    ctx := context.Background()
+    go runPool(ctx, reg)
+    go runPipeline(ctx, reg)
+
     http.HandleFunc("/", handler)
-    fmt.Println("Server starting on :8080")
+    http.Handle("/metrics", reg)
+    fmt.Println("Server starting on :8080 (metrics at /metrics)")
     http.ListenAndServe(":8080", nil)
-} 
\ No newline at end of file
+}
@@ -1,52 +1,42 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "sync"
+
+    "workerpool"
 )
 
-// Simple worker that processes numbers
-func worker(id int, numbers <-chan int, results chan<- int, wg *sync.WaitGroup) {
-    defer wg.Done()
-    
-    for num := range numbers {
-        // Process the number (multiply by 2)
-        result := num * 2
-        fmt.Printf("Worker %d processed %d -> %d\n", id, num, result)
-        results <- result
-    }
+// Simple job that processes numbers
+func double(ctx context.Context, id int, num int) (int, error) {
+    // Process the number (multiply by 2)
+    result := num * 2
+    fmt.Printf("Worker %d processed %d -> %d\n", id, num, result)
+    return result, nil
 }
 
 func main() {
-    numbers := make(chan int, 10)
-    results := make(chan int, 10)
-    
+    ctx := context.Background()
+
     // Start 3 workers
-    var wg sync.WaitGroup
-    for i := 1; i <= 3; i++ {
-        wg.Add(1)
-        go worker(i, numbers, results, &wg)
-    }
+    pool := workerpool.New(ctx, 3, double,
+        workerpool.WithQueueSize(10),
+        workerpool.WithResultBuffer(10),
+    )
     
     // Send numbers to process
     go func() {
         for i := 1; i <= 10; i++ {
-            numbers <- i
+            pool.Submit(ctx, i, i)
         }
-        close(numbers)
-    }()
-    
-    // Wait for workers and close results
-    go func() {
-        wg.Wait()
-        close(results)
+        pool.Close()
     }()
     
     // Collect results
     var processedNumbers []int
-    for result := range results {
-        processedNumbers = append(processedNumbers, result)
+    for result := range pool.Results() {
+        processedNumbers = append(processedNumbers, result.Value)
     }
     
     fmt.Printf("Processed numbers: %v\n", processedNumbers)
-} 
\ No newline at end of file
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+    "context"
     "fmt"
     "sync"
     "time"
+
+    "pipeline"
 )
 
 type Task struct {
@@ -57,16 +60,17 @@ func main() {
         close(taskChan)
     }()
 
-    // Fan-in: Collect results from all output channels
-    go func() {
-        wg.Wait() // Wait for all workers to finish
-    }()
+    // Fan-in: results arrive as soon as any worker has one, so a slow
+    // worker 1 does not hold back worker 3
+    merged := pipeline.NewMerger[string](context.Background())
+    for _, ch := range outputs {
+        merged.Add(ch)
+    }
+    merged.Close()
 
-    // Read from all output channels
-    for i, ch := range outputs {
-        fmt.Printf("\nResults from Worker %d:\n", i+1)
-        for result := range ch {
-            fmt.Printf("%s\n", result)
-        }
+    fmt.Println("\nResults:")
+    for result := range merged.Out() {
+        fmt.Printf("%s\n", result)
     }
-} 
\ No newline at end of file
+    wg.Wait()
+}
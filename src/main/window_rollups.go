@@ -0,0 +1,64 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math/rand"
+    "time"
+
+    "pipeline"
+)
+
+// Request is one latency sample reported by a service
+type Request struct {
+    At       time.Time
+    Endpoint string
+    Latency  time.Duration
+}
+
+// Samples arrive slightly out of order, like reports from several hosts
+func requests(ctx context.Context, emit func(Request) error) error {
+    start := time.Now().Truncate(time.Second)
+    endpoints := []string{"/orders", "/users"}
+    for i := 0; i < 60; i++ {
+        at := start.Add(time.Duration(i)*50*time.Millisecond - time.Duration(rand.Intn(200))*time.Millisecond)
+        req := Request{
+            At:       at,
+            Endpoint: endpoints[i%len(endpoints)],
+            Latency:  time.Duration(20+rand.Intn(80)) * time.Millisecond,
+        }
+        if i == 45 {
+            req.At = start // far too late, its window is long gone
+        }
+        if err := emit(req); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func main() {
+    p := pipeline.New(context.Background())
+    reqs := pipeline.Source(p, "requests", requests)
+
+    // Per-endpoint one-second rollups, tolerating 300ms of disorder
+    panes := pipeline.Window(p, "rollup", reqs, pipeline.Tumbling(time.Second),
+        pipeline.WithEventTime(func(r Request) time.Time { return r.At }),
+        pipeline.WithKey(func(r Request) string { return r.Endpoint }),
+        pipeline.WithAllowedLateness[Request](300*time.Millisecond),
+        pipeline.WithLateItems(func(r Request) {
+            fmt.Printf("late sample for %s at %s dropped\n", r.Endpoint, r.At.Format("15:04:05.000"))
+        }),
+    )
+
+    pipeline.Sink(p, "print", panes, func(ctx context.Context, pane pipeline.Pane[Request]) error {
+        s := pane.Summary(func(r Request) float64 { return float64(r.Latency.Milliseconds()) })
+        fmt.Printf("%s %-8s count=%2d min=%3.0fms p50=%5.1fms p95=%5.1fms max=%3.0fms\n",
+            pane.Start.Format("15:04:05"), pane.Key, s.Count, s.Min, s.Percentile(50), s.Percentile(95), s.Max)
+        return nil
+    })
+
+    if err := p.Wait(); err != nil {
+        fmt.Println("Pipeline failed:", err)
+    }
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"os"
+	"path/filepath"
 	"time"
+
+	"jobqueue"
+	"pipeline"
+	"workerpool"
 )
 
 // Job types and their processors
@@ -13,6 +19,17 @@ const (
 	Calculation       // 2
 )
 
+// Job type names, used as rate-limit kinds
+var jobTypeNames = map[int]string{
+	ProcessData:   "ProcessData",
+	FileOperation: "FileOperation",
+	Calculation:   "Calculation",
+}
+
+func jobType(jobID int) string {
+	return jobTypeNames[jobID%3]
+}
+
 // Process different types of jobs
 func processJob(jobID int) int {
 	// Determine job type by modulo
@@ -35,63 +52,99 @@ func processJob(jobID int) int {
 	return 0
 }
 
-// Worker function to process jobs
-func worker(id int, jobs <-chan int, results chan<- int, wg *sync.WaitGroup) {
-	defer wg.Done()  // Mark this worker as done when finished
-
-	// Process jobs until channel is closed
-	for job := range jobs {
-		// Log start of job
-		fmt.Printf("Worker %d starting job %d\n", id, job)
-		
-		// Process the job
-		result := processJob(job)
-		
-		// Safely send result
-		select {
-		case results <- result:
-			fmt.Printf("Worker %d completed job %d with result %d\n", id, job, result)
-		default:
-			fmt.Printf("Worker %d couldn't send result for job %d\n", id, job)
-			return
-		}
-	}
-}
-
 func main() {
 	fmt.Println("\n=== Worker Pool Example ===")
 	
 	const numJobs = 6
 	const numWorkers = 3
 	
-	// Create buffered channels for jobs and results
-	jobs := make(chan int, numJobs)
-	results := make(chan int, numJobs)
-	
-	// WaitGroup to track workers
-	var wg sync.WaitGroup
+	ctx := context.Background()
 	
-	// Start workers
-	for w := 1; w <= numWorkers; w++ {
-		wg.Add(1)
-		go worker(w, jobs, results, &wg)
+	// Jobs live in an on-disk queue, so a crash doesn't lose them: the next
+	// run picks up whatever was queued or in flight but never acked
+	queue, err := jobqueue.Open[int](filepath.Join(os.TempDir(), "worker_pool_queue"),
+		jobqueue.Options{Sync: true, VisibilityTimeout: 5 * time.Second})
+	if err != nil {
+		fmt.Println("Error opening job queue:", err)
+		return
 	}
+	defer queue.Close()
 	
-	// Send jobs
-	for j := 1; j <= numJobs; j++ {
-		jobs <- j
+	if pending := queue.Len(); pending > 0 {
+		fmt.Printf("Recovered %d unfinished jobs from the last run\n", pending)
+	} else {
+		for j := 1; j <= numJobs; j++ {
+			queue.Enqueue(j)
+		}
 	}
-	close(jobs)  // No more jobs to send
 	
-	// Wait for workers in separate goroutine
+	// Each worker runs processJob; the pool owns the channels and WaitGroup
+	pool := workerpool.New(ctx, numWorkers,
+		func(ctx context.Context, workerID int, job int) (int, error) {
+			fmt.Printf("Worker %d starting job %d\n", workerID, job)
+			return processJob(job), nil
+		},
+		// Small results buffer: anything that doesn't fit is parked on disk
+		// and replayed instead of being silently dropped
+		workerpool.WithResultBuffer(2),
+		workerpool.WithOverflowPolicy(workerpool.SpillToDisk),
+	)
+	
+	// Per-type limits, enforced by the dispatcher in front of the pool.
+	// They can be changed with SetLimit while jobs are running.
+	limiter := workerpool.NewLimiter()
+	limiter.SetLimit("FileOperation", workerpool.Limit{MaxConcurrent: 2})
+	limiter.SetLimit("Calculation", workerpool.Limit{Rate: 50})
+	dispatcher := workerpool.NewDispatcher[int](ctx, pool,
+		func(int) int { return 0 }, 0,
+		workerpool.WithLimiter(limiter, jobType))
+	
+	// Feed jobs from the queue until it is empty
+	feedCtx, stopFeed := context.WithCancel(ctx)
+	defer stopFeed()
 	go func() {
-		wg.Wait()
-		close(results)  // Close results when all workers done
-		fmt.Println("All workers finished")
+		for msg := range queue.Chan(feedCtx) {
+			if err := dispatcher.Submit(feedCtx, msg.ID, msg.Payload); err != nil {
+				queue.Nack(msg.ID)
+			}
+		}
+		dispatcher.Close()  // No more jobs to send; closes the pool once drained
 	}()
 	
-	// Collect results
-	for result := range results {
-		fmt.Printf("Got result: %d\n", result)
+	// Store results in batches and ack a batch once it is stored. The
+	// results channel closes when all workers are done.
+	store := func(ctx context.Context, batch []workerpool.Result[int]) error {
+		fmt.Printf("Storing a batch of %d results\n", len(batch))
+		for _, result := range batch {
+			if result.Err != nil {
+				queue.Nack(result.JobID)
+				continue
+			}
+			fmt.Printf("Worker %d completed job %d with result %d\n", result.WorkerID, result.JobID, result.Value)
+			queue.Ack(result.JobID)
+		}
+		if queue.Len() == 0 && queue.InFlight() == 0 {
+			stopFeed()
+		}
+		return nil
+	}
+	batcher := pipeline.NewBatcher(ctx, pool.Results(), store, pipeline.BatcherOptions[workerpool.Result[int]]{
+		MaxItems:    4,
+		MaxWait:     250 * time.Millisecond,
+		MaxInFlight: 1,
+	})
+	if err := batcher.Wait(); err != nil {
+		fmt.Println("Error storing results:", err)
+	}
+	fmt.Println("All workers finished")
+	
+	b := batcher.Stats()
+	fmt.Printf("Batches: %d (full=%d timeout=%d final=%d)\n", b.Batches, b.Full, b.Timeout, b.Final)
+	stats := pool.Stats()
+	fmt.Printf("Overflow: blocked=%d dropped_newest=%d dropped_oldest=%d spilled=%d failed=%d\n",
+		stats.Blocked, stats.DroppedNewest, stats.DroppedOldest, stats.Spilled, stats.Failed)
+	for _, k := range stats.Kinds {
+		fmt.Printf("%-13s limit=%+v admitted=%d throttled=%d running=%d\n",
+			k.Kind, k.Limit, k.Admitted, k.Throttled, k.Running)
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,394 @@
+// Package metrics is a small metrics registry (counters, gauges and
+// histograms) that renders in the Prometheus text exposition format.
+//
+//	reg := metrics.NewRegistry()
+//	jobs := reg.Counter("jobs_total", "Jobs processed", nil)
+//	jobs.Inc()
+//	http.Handle("/metrics", reg)
+//
+// Every metric type is safe for concurrent use, and methods on a nil
+// *Counter, *Gauge or *Histogram do nothing, so instrumented code does not
+// need to check whether metrics were configured.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Labels are the label names and values of one series
+type Labels map[string]string
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// series is anything that can write its samples
+type series interface {
+	write(w *bufio.Writer, name, labels string)
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   kind
+	series map[string]series // keyed by rendered labels
+}
+
+// Registry holds metrics and renders them for scraping
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// register returns the series for name and labels, creating it with create
+// if it does not exist. Reusing a name with a different type panics, since
+// the scrape output would be invalid.
+func (r *Registry) register(name, help string, k kind, labels Labels, create func() series, replace bool) series {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: k, series: make(map[string]series)}
+		r.families[name] = f
+	}
+	if f.kind != k {
+		panic(fmt.Sprintf("metrics: %s registered as %s and %s", name, f.kind, k))
+	}
+
+	key := renderLabels(labels)
+	s, ok := f.series[key]
+	if !ok || replace {
+		s = create()
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter returns the counter for name and labels, creating it on first use
+func (r *Registry) Counter(name, help string, labels Labels) *Counter {
+	s := r.register(name, help, counterKind, labels, func() series { return &Counter{} }, false)
+	c, ok := s.(*Counter)
+	if !ok {
+		panic(fmt.Sprintf("metrics: %s%s is a counter func", name, renderLabels(labels)))
+	}
+	return c
+}
+
+// CounterFunc registers a counter whose value is read from fn at scrape
+// time, replacing any earlier series with the same labels. fn must only
+// ever go up.
+func (r *Registry) CounterFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, counterKind, labels, func() series { return valueFunc(fn) }, true)
+}
+
+// Gauge returns the gauge for name and labels, creating it on first use
+func (r *Registry) Gauge(name, help string, labels Labels) *Gauge {
+	s := r.register(name, help, gaugeKind, labels, func() series { return &Gauge{} }, false)
+	g, ok := s.(*Gauge)
+	if !ok {
+		panic(fmt.Sprintf("metrics: %s%s is a gauge func", name, renderLabels(labels)))
+	}
+	return g
+}
+
+// GaugeFunc registers a gauge whose value is read from fn at scrape time,
+// replacing any earlier series with the same labels
+func (r *Registry) GaugeFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, gaugeKind, labels, func() series { return valueFunc(fn) }, true)
+}
+
+// Histogram returns the histogram for name and labels, creating it on first
+// use. buckets are upper bounds; nil means DefBuckets.
+func (r *Registry) Histogram(name, help string, labels Labels, buckets []float64) *Histogram {
+	s := r.register(name, help, histogramKind, labels, func() series { return newHistogram(buckets) }, false)
+	return s.(*Histogram)
+}
+
+// WriteTo writes every metric in the Prometheus text format, families and
+// series sorted so the output is stable
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	type entry struct {
+		labels string
+		s      series
+	}
+	snapshot := make([][]entry, len(families))
+	for i, f := range families {
+		for labels, s := range f.series {
+			snapshot[i] = append(snapshot[i], entry{labels, s})
+		}
+		sort.Slice(snapshot[i], func(a, b int) bool { return snapshot[i][a].labels < snapshot[i][b].labels })
+	}
+	r.mu.Unlock()
+
+	// Func metrics run outside the lock so they may use the registry
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for i, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		for _, e := range snapshot[i] {
+			e.s.write(bw, f.name, e.labels)
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the registry to a Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Inc adds one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64) {
+	if c == nil {
+		return
+	}
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current count
+func (c *Counter) Value() float64 {
+	if c == nil {
+		return 0
+	}
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (c *Counter) write(w *bufio.Writer, name, labels string) {
+	writeSample(w, name, labels, c.Value())
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set replaces the value
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds v, which may be negative
+func (g *Gauge) Add(v float64) {
+	if g == nil {
+		return
+	}
+	addFloat(&g.bits, v)
+}
+
+// Inc adds one
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts one
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) write(w *bufio.Writer, name, labels string) {
+	writeSample(w, name, labels, g.Value())
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // observations per bucket, not cumulative; last is +Inf
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	if bounds == nil {
+		bounds = DefBuckets
+	}
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, buckets: make([]uint64, len(bounds)+1)}
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets[i]++
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	h.mu.Lock()
+	buckets := append([]uint64(nil), h.buckets...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, n := range buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		writeSample(w, name+"_bucket", withLabel(labels, "le", le), float64(cumulative))
+	}
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+// valueFunc is a counter or gauge read at scrape time
+type valueFunc func() float64
+
+func (f valueFunc) write(w *bufio.Writer, name, labels string) {
+	writeSample(w, name, labels, f())
+}
+
+func addFloat(bits *atomic.Uint64, v float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// renderLabels turns labels into {a="1",b="2"}, sorted by name
+func renderLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds one more label to already rendered labels
+func withLabel(labels, name, value string) string {
+	pair := fmt.Sprintf("%s=\"%s\"", name, escapeLabel(value))
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
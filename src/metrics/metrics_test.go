@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpositionFormat(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("jobs_total", "Jobs done.", Labels{"pool": "a"}).Add(3)
+	reg.Counter("jobs_total", "Jobs done.", Labels{"pool": "a"}).Inc() // same series
+	reg.Gauge("depth", "Queue depth.", nil).Set(-2)
+	reg.GaugeFunc("workers", "Workers.", Labels{"name": `q"1`}, func() float64 { return 4 })
+	h := reg.Histogram("latency_seconds", "Latency.", nil, []float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(v)
+	}
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP depth Queue depth.
+# TYPE depth gauge
+depth -2
+# HELP jobs_total Jobs done.
+# TYPE jobs_total counter
+jobs_total{pool="a"} 4
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP workers Workers.
+# TYPE workers gauge
+workers{name="q\"1"} 4
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+}
+
+func TestNilMetricsAreNoOps(t *testing.T) {
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	var s *Stage
+	c.Inc()
+	g.Set(1)
+	h.Observe(1)
+	s.Observe(time.Now())
+	if c.Value() != 0 || g.Value() != 0 || h.Count() != 0 {
+		t.Error("nil metrics recorded something")
+	}
+}
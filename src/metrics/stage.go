@@ -0,0 +1,33 @@
+package metrics
+
+import "time"
+
+// Stage is the set of metrics kept for one pipeline stage
+type Stage struct {
+	In       *Counter   // items received from upstream
+	Out      *Counter   // items sent downstream
+	Dropped  *Counter   // items filtered out or discarded
+	Errors   *Counter   // items that failed
+	Duration *Histogram // time spent on one item, in seconds
+}
+
+// Stage returns the metrics for one stage of a pipeline. A nil *Stage
+// records nothing.
+func (r *Registry) Stage(pipeline, stage string) *Stage {
+	labels := Labels{"pipeline": pipeline, "stage": stage}
+	return &Stage{
+		In:       r.Counter("pipeline_stage_items_in_total", "Items received by a pipeline stage.", labels),
+		Out:      r.Counter("pipeline_stage_items_out_total", "Items sent downstream by a pipeline stage.", labels),
+		Dropped:  r.Counter("pipeline_stage_items_dropped_total", "Items filtered out or discarded by a pipeline stage.", labels),
+		Errors:   r.Counter("pipeline_stage_errors_total", "Items a pipeline stage failed to process.", labels),
+		Duration: r.Histogram("pipeline_stage_duration_seconds", "Time a pipeline stage spent on one item.", labels, nil),
+	}
+}
+
+// Observe records one item processed since start
+func (s *Stage) Observe(start time.Time) {
+	if s == nil {
+		return
+	}
+	s.Duration.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatcherOptions says when a Batcher flushes. A batch is written as soon
+// as any limit is reached; zero limits are not checked.
+type BatcherOptions[T any] struct {
+	// MaxItems flushes a batch holding this many items
+	MaxItems int
+
+	// MaxBytes flushes before a batch would grow past this many bytes, as
+	// measured by Size. A single item larger than MaxBytes is written on
+	// its own.
+	MaxBytes int
+	Size     func(item T) int
+
+	// MaxWait flushes a batch this long after its first item arrived
+	MaxWait time.Duration
+
+	// MaxInFlight is how many batches may be written at once (default 1).
+	// When they all are, the batcher stops reading its input.
+	MaxInFlight int
+}
+
+// BatcherStats counts the batches written and why they were flushed
+type BatcherStats struct {
+	Batches int64
+	Items   int64
+	Full    int64 // reached MaxItems
+	Bytes   int64 // reached MaxBytes
+	Timeout int64 // reached MaxWait
+	Final   int64 // input closed or context done
+	Failed  int64 // write returned an error
+}
+
+// Batcher reads items from a channel and writes them in batches. When
+// its context is done it writes what it holds, with a context that is no
+// longer cancelled, and stops.
+type Batcher[T any] struct {
+	opts  BatcherOptions[T]
+	write func(ctx context.Context, batch []T) error
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+
+	batches, items, full, bytes, timeout, final, failed atomic.Int64
+}
+
+// NewBatcher starts writing the items of in with write
+func NewBatcher[T any](ctx context.Context, in <-chan T, write func(ctx context.Context, batch []T) error, opts BatcherOptions[T]) *Batcher[T] {
+	if opts.MaxInFlight < 1 {
+		opts.MaxInFlight = 1
+	}
+	if opts.Size == nil {
+		opts.MaxBytes = 0
+	}
+	b := &Batcher[T]{
+		opts:  opts,
+		write: write,
+		slots: make(chan struct{}, opts.MaxInFlight),
+	}
+	b.wg.Add(1)
+	go b.run(ctx, in)
+	return b
+}
+
+// Wait blocks until the input is drained or the context is done and
+// every batch has been written. It returns the errors of failed writes.
+func (b *Batcher[T]) Wait() error {
+	b.wg.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return errors.Join(b.errs...)
+}
+
+// Stats returns the counts so far
+func (b *Batcher[T]) Stats() BatcherStats {
+	return BatcherStats{
+		Batches: b.batches.Load(),
+		Items:   b.items.Load(),
+		Full:    b.full.Load(),
+		Bytes:   b.bytes.Load(),
+		Timeout: b.timeout.Load(),
+		Final:   b.final.Load(),
+		Failed:  b.failed.Load(),
+	}
+}
+
+func (b *Batcher[T]) run(ctx context.Context, in <-chan T) {
+	defer b.wg.Done()
+	// The last batch is written even though ctx may be cancelled
+	writeCtx := context.WithoutCancel(ctx)
+
+	var batch []T
+	size := 0
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	flush := func(reason *atomic.Int64) {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		reason.Add(1)
+		b.start(writeCtx, batch)
+		batch, size = nil, 0
+	}
+
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				flush(&b.final)
+				return
+			}
+			n := 0
+			if b.opts.MaxBytes > 0 {
+				n = b.opts.Size(item)
+				if len(batch) > 0 && size+n > b.opts.MaxBytes {
+					flush(&b.bytes)
+				}
+			}
+			batch = append(batch, item)
+			size += n
+			if len(batch) == 1 && b.opts.MaxWait > 0 {
+				timer = time.NewTimer(b.opts.MaxWait)
+				expired = timer.C
+			}
+			switch {
+			case b.opts.MaxItems > 0 && len(batch) >= b.opts.MaxItems:
+				flush(&b.full)
+			case b.opts.MaxBytes > 0 && size >= b.opts.MaxBytes:
+				flush(&b.bytes)
+			}
+		case <-expired:
+			flush(&b.timeout)
+		case <-ctx.Done():
+			flush(&b.final)
+			return
+		}
+	}
+}
+
+// start writes batch in the background once an in-flight slot is free.
+// Waiting for the slot is what pushes back on the input.
+func (b *Batcher[T]) start(ctx context.Context, batch []T) {
+	b.slots <- struct{}{}
+	b.batches.Add(1)
+	b.items.Add(int64(len(batch)))
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.slots }()
+		if err := safely(func() error { return b.write(ctx, batch) }); err != nil {
+			b.failed.Add(1)
+			b.mu.Lock()
+			b.errs = append(b.errs, err)
+			b.mu.Unlock()
+		}
+	}()
+}
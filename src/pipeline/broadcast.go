@@ -0,0 +1,238 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+// ErrBroadcasterClosed is returned by Subscribe once the broadcaster's
+// input is closed or its context is done
+var ErrBroadcasterClosed = errors.New("pipeline: broadcaster closed")
+
+// ErrSlowSubscriber is the Err of a subscription disconnected because its
+// buffer was full
+var ErrSlowSubscriber = errors.New("pipeline: subscriber too slow")
+
+// SlowPolicy says what a Broadcaster does when a subscriber's buffer is full
+type SlowPolicy int
+
+const (
+	Block      SlowPolicy = iota // wait for the subscriber, holding back every other one (default)
+	Drop                         // skip the item for that subscriber only
+	Disconnect                   // end the subscription with ErrSlowSubscriber
+)
+
+func (p SlowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case Drop:
+		return "drop"
+	case Disconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("SlowPolicy(%d)", int(p))
+}
+
+// Broadcaster delivers every item of its input to every subscriber.
+// Subscribers can join and leave while it runs; each sees the items sent
+// after it joined. Subscriptions are closed when the input closes or ctx
+// is done.
+type Broadcaster[T any] struct {
+	ops  chan broadcastOp[T]
+	done chan struct{}
+}
+
+// Subscription is one subscriber of a Broadcaster
+type Subscription[T any] struct {
+	// C receives the items; it is closed when the subscription ends
+	C <-chan T
+
+	ch      chan T
+	policy  SlowPolicy
+	dropped atomic.Int64
+	slow    atomic.Bool
+	b       *Broadcaster[T]
+}
+
+type broadcastOp[T any] struct {
+	sub   *Subscription[T]
+	join  bool
+	reply chan bool
+}
+
+// NewBroadcaster starts copying in to subscribers. Items that arrive
+// while there are none are discarded.
+func NewBroadcaster[T any](ctx context.Context, in <-chan T) *Broadcaster[T] {
+	b := &Broadcaster[T]{
+		ops:  make(chan broadcastOp[T]),
+		done: make(chan struct{}),
+	}
+	go b.run(ctx, in)
+	return b
+}
+
+// Subscribe adds a subscriber with room for buffer items
+func (b *Broadcaster[T]) Subscribe(buffer int, policy SlowPolicy) (*Subscription[T], error) {
+	ch := make(chan T, max(buffer, 0))
+	s := &Subscription[T]{C: ch, ch: ch, policy: policy, b: b}
+	if !b.do(broadcastOp[T]{sub: s, join: true}) {
+		return nil, ErrBroadcasterClosed
+	}
+	return s, nil
+}
+
+// Close leaves the broadcaster. C is closed, possibly after some buffered
+// items, so it is safe to keep reading it until then.
+func (s *Subscription[T]) Close() {
+	s.b.do(broadcastOp[T]{sub: s})
+}
+
+// Dropped returns how many items a Drop subscriber missed
+func (s *Subscription[T]) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Err returns ErrSlowSubscriber once a Disconnect subscriber has been cut
+// off, and nil otherwise
+func (s *Subscription[T]) Err() error {
+	if s.slow.Load() {
+		return ErrSlowSubscriber
+	}
+	return nil
+}
+
+func (b *Broadcaster[T]) do(op broadcastOp[T]) bool {
+	op.reply = make(chan bool, 1)
+	select {
+	case b.ops <- op:
+		return <-op.reply
+	case <-b.done:
+		return false
+	}
+}
+
+func (b *Broadcaster[T]) run(ctx context.Context, in <-chan T) {
+	var subs []*Subscription[T]
+	defer func() {
+		close(b.done)
+		for _, s := range subs {
+			close(s.ch)
+		}
+	}()
+
+	leave := func(s *Subscription[T]) bool {
+		i := slices.Index(subs, s)
+		if i < 0 {
+			return false
+		}
+		subs = slices.Delete(subs, i, i+1)
+		close(s.ch)
+		return true
+	}
+	handle := func(op broadcastOp[T]) {
+		if op.join {
+			subs = append(subs, op.sub)
+			op.reply <- true
+			return
+		}
+		op.reply <- leave(op.sub)
+	}
+
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				return
+			}
+			for _, s := range slices.Clone(subs) {
+				if !slices.Contains(subs, s) {
+					continue // left while an earlier one blocked
+				}
+				if !b.deliver(ctx, s, item, handle, leave) {
+					return
+				}
+			}
+		case op := <-b.ops:
+			handle(op)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver hands item to s according to its policy. It returns false if
+// ctx is done.
+func (b *Broadcaster[T]) deliver(ctx context.Context, s *Subscription[T], item T, handle func(broadcastOp[T]), leave func(*Subscription[T]) bool) bool {
+	select {
+	case s.ch <- item:
+		return true
+	default:
+	}
+
+	switch s.policy {
+	case Drop:
+		s.dropped.Add(1)
+		return true
+	case Disconnect:
+		s.slow.Store(true)
+		leave(s)
+		return true
+	}
+
+	// Block, but keep serving joins and leaves; s itself may leave
+	for {
+		select {
+		case s.ch <- item:
+			return true
+		case op := <-b.ops:
+			handle(op)
+			if !op.join && op.sub == s {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Tee sends every item to n outputs. A slow reader of one output holds
+// back all of them, up to each output's buffer. A negative n fails the
+// stage, and Tee returns no outputs.
+func Tee[T any](p *Pipeline, name string, in <-chan T, n int) []<-chan T {
+	if n < 0 {
+		p.spawn(name, func(context.Context, *stageMeter) error {
+			return fmt.Errorf("tee needs a non-negative number of outputs, got %d", n)
+		})
+		return nil
+	}
+
+	outs := make([]chan T, n)
+	result := make([]<-chan T, n)
+	for i := range outs {
+		outs[i] = make(chan T, p.buffer(name))
+		result[i] = outs[i]
+	}
+
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for item := range receive(in, m) {
+			m.received()
+			for _, out := range outs {
+				if !send(ctx, p, out, item, m) {
+					return nil
+				}
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return result
+}
@@ -0,0 +1,410 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointFile = "checkpoint.json"
+	keysExt        = ".keys"
+)
+
+// Checkpoints stores the progress of a pipeline in a directory so a run
+// that dies can resume where the last checkpoint left off.
+//
+// A checkpoint is only taken when the pipeline is quiet: sources are
+// paused and every item they emitted has either reached a sink or been
+// absorbed into the state of a stage such as Batch, Window or
+// StatefulMap. Source offsets and stage states in one checkpoint
+// therefore always match. Items handled after the last checkpoint are
+// processed again on resume, which gives at-least-once delivery;
+// DedupeSink turns that into idempotent output.
+type Checkpoints struct {
+	dir string
+
+	mu     sync.Mutex
+	saved  time.Time
+	states map[string]json.RawMessage
+}
+
+type checkpointDoc struct {
+	Saved  time.Time                  `json:"saved"`
+	States map[string]json.RawMessage `json:"states"`
+}
+
+// OpenCheckpoints loads the last checkpoint in dir, creating dir if needed
+func OpenCheckpoints(dir string) (*Checkpoints, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &Checkpoints{dir: dir, states: make(map[string]json.RawMessage)}
+
+	data, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc checkpointDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("pipeline: reading checkpoint: %w", err)
+	}
+	c.saved = doc.Saved
+	if doc.States != nil {
+		c.states = doc.States
+	}
+	return c, nil
+}
+
+// Saved returns when the loaded or last written checkpoint was taken;
+// zero means there is none and the run starts from scratch
+func (c *Checkpoints) Saved() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saved
+}
+
+// Reset deletes the checkpoint and every dedupe key so the next run
+// starts over
+func (c *Checkpoints) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saved = time.Time{}
+	c.states = make(map[string]json.RawMessage)
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == checkpointFile || filepath.Ext(e.Name()) == keysExt {
+			if err := os.Remove(filepath.Join(c.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Checkpoints) load(name string, v any) error {
+	c.mu.Lock()
+	raw, ok := c.states[name]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("pipeline: restoring %q: %w", name, err)
+	}
+	return nil
+}
+
+// save atomically replaces the checkpoint file
+func (c *Checkpoints) save(states map[string]json.RawMessage) error {
+	doc := checkpointDoc{Saved: time.Now(), States: states}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, checkpointFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, checkpointFile)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saved, c.states = doc.Saved, states
+	return nil
+}
+
+// WithCheckpoints restores stage state from cp and checkpoints the
+// pipeline every interval, and once more when it finishes without error
+func WithCheckpoints(cp *Checkpoints, every time.Duration) Option {
+	return func(c *config) {
+		c.checkpoints = cp
+		c.every = every
+	}
+}
+
+// stageState is the part of a stage that goes into checkpoints
+type stageState struct {
+	mu    sync.Mutex // held by the stage while it changes state
+	state any        // pointer to the state, marshalled as JSON
+}
+
+// stateful registers state (a pointer) under name, fills it in from the
+// last checkpoint, and returns the lock the stage must hold while it
+// changes it
+func (p *Pipeline) stateful(name string, state any) *sync.Mutex {
+	if _, ok := p.states[name]; ok {
+		panic(fmt.Sprintf("pipeline: two stateful stages named %q", name))
+	}
+	st := &stageState{state: state}
+	p.states[name] = st
+
+	if cp := p.cfg.checkpoints; cp != nil {
+		if err := cp.load(name, state); err != nil {
+			p.fail(err)
+		}
+		if len(p.states) == 1 {
+			go p.checkpointLoop()
+		}
+	}
+	return &st.mu
+}
+
+// checkpointLoop takes a checkpoint every interval until the pipeline's
+// context is done
+func (p *Pipeline) checkpointLoop() {
+	defer close(p.cpDone)
+	if p.cfg.every <= 0 {
+		<-p.ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(p.cfg.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkpoint(p.cfg.every)
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// finishCheckpoints stops the loop once every stage has exited and saves
+// the final state if the run succeeded
+func (p *Pipeline) finishCheckpoints() {
+	if p.cpDone == nil || len(p.states) == 0 {
+		return
+	}
+	ok := p.ctx.Err() == nil
+	p.cancel(nil)
+	<-p.cpDone
+	if ok {
+		if err := p.snapshotAndSave(); err != nil {
+			p.fail(err)
+		}
+	}
+}
+
+// checkpoint pauses the sources, waits up to timeout for the pipeline to
+// drain and saves a checkpoint. If it does not drain in time the attempt
+// is skipped.
+func (p *Pipeline) checkpoint(timeout time.Duration) {
+	p.gate.Lock()
+	defer p.gate.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && p.ctx.Err() == nil {
+		if p.inflight.Load() > 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		// Stages may still move items on their own (batch timers,
+		// window ticks); with every state locked nothing can
+		for _, st := range p.states {
+			st.mu.Lock()
+		}
+		quiet := p.inflight.Load() == 0
+		var err error
+		if quiet {
+			err = p.snapshotAndSave()
+		}
+		for _, st := range p.states {
+			st.mu.Unlock()
+		}
+		if err != nil {
+			p.fail(err)
+		}
+		if quiet {
+			return
+		}
+	}
+}
+
+// snapshotAndSave marshals every stage state; callers make sure the
+// states are not changing
+func (p *Pipeline) snapshotAndSave() error {
+	states := make(map[string]json.RawMessage, len(p.states))
+	for name, st := range p.states {
+		raw, err := json.Marshal(st.state)
+		if err != nil {
+			return fmt.Errorf("pipeline: checkpointing %q: %w", name, err)
+		}
+		states[name] = raw
+	}
+	return p.cfg.checkpoints.save(states)
+}
+
+// ResumableSource is Source for a generator that can start part way. gen
+// receives the number of items emitted before the last checkpoint and
+// should skip that many.
+func ResumableSource[T any](p *Pipeline, name string, gen func(ctx context.Context, offset int64, emit func(T) error) error) <-chan T {
+	var offset int64
+	mu := p.stateful(name, &offset)
+	start := offset
+	return source(p, name, func(ctx context.Context, emit func(T) error) error {
+		return gen(ctx, start, emit)
+	}, func() {
+		mu.Lock()
+		offset++
+		mu.Unlock()
+	})
+}
+
+// StatefulMap is Map for a function that keeps state between items, such
+// as a running total. The state is checkpointed, so it must survive a
+// JSON round trip.
+func StatefulMap[In, Out, S any](p *Pipeline, name string, in <-chan In, fn func(ctx context.Context, state *S, item In) (Out, error)) <-chan Out {
+	out := make(chan Out, p.buffer(name))
+	var state S
+	mu := p.stateful(name, &state)
+
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		for item := range receive(in, m) {
+			m.received()
+			mu.Lock()
+			var v Out
+			ok, err := p.attempt(ctx, name, m, item, func() (err error) {
+				v, err = fn(ctx, &state, item)
+				return err
+			})
+			if err == nil && ok && !send(ctx, p, out, v, m) {
+				mu.Unlock()
+				return nil
+			}
+			if err == nil {
+				p.done(1)
+			}
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return out
+}
+
+// DedupeSink is Sink for output that must not repeat. Items whose key was
+// already written are dropped. With checkpoints the keys are appended to
+// a file in the checkpoint directory once fn succeeds, so items replayed
+// after a restart are recognised; without them keys are only remembered
+// for this run. An item whose fn succeeded just before a crash, with its
+// key not yet written, is written again.
+func DedupeSink[T any](p *Pipeline, name string, in <-chan T, key func(item T) string, fn func(ctx context.Context, item T) error) {
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		seen := make(map[string]bool)
+		var log *os.File
+		if cp := p.cfg.checkpoints; cp != nil {
+			var err error
+			if log, err = openKeys(filepath.Join(cp.dir, name+keysExt), seen); err != nil {
+				return err
+			}
+			defer log.Close()
+		}
+
+		for {
+			start := time.Now()
+			select {
+			case item, ok := <-in:
+				m.waited(start)
+				if !ok {
+					return nil
+				}
+				m.received()
+				k := key(item)
+				if seen[k] {
+					m.Dropped.Inc()
+					p.done(1)
+					continue
+				}
+				ok, err := p.attempt(ctx, name, m, item, func() error { return fn(ctx, item) })
+				if err != nil {
+					return err
+				}
+				if ok {
+					seen[k] = true
+					if log != nil {
+						if err := appendKey(log, k); err != nil {
+							return err
+						}
+					}
+				}
+				p.done(1)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+}
+
+// openKeys reads the keys written so far into seen and opens the file for
+// appending. Keys are stored one JSON string per line; a torn last line
+// from a crash is ignored.
+func openKeys(path string, seen map[string]bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var k string
+		if json.Unmarshal(sc.Bytes(), &k) == nil {
+			seen[k] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Start a fresh line after a torn one
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+func appendKey(f *os.File, k string) error {
+	line, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,227 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"workerpool"
+)
+
+// Item carries a value through a pipeline, or the error that took its
+// place. Settle hands the errors to the pipeline's error strategy.
+type Item[T any] struct {
+	Value T
+	Err   error
+}
+
+// ItemError is one item a stage failed to process
+type ItemError struct {
+	Stage    string
+	Item     any
+	Err      error
+	Attempts int
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("stage %q: item %v: %v", e.Stage, e.Item, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorReport is what Wait returns when items failed without stopping the
+// pipeline. Fatal is set as well if the pipeline was stopped.
+type ErrorReport struct {
+	Fatal error
+	Items []*ItemError
+	// Dropped counts the failures after the first WithMaxItemErrors,
+	// which are not in Items
+	Dropped int
+}
+
+func (r *ErrorReport) Error() string {
+	counts := map[string]int{}
+	for _, e := range r.Items {
+		counts[e.Stage]++
+	}
+	stages := make([]string, 0, len(counts))
+	for stage := range counts {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "pipeline: %d items failed (", len(r.Items)+r.Dropped)
+	for i, stage := range stages {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d", stage, counts[stage])
+	}
+	if r.Dropped > 0 {
+		fmt.Fprintf(&b, ", %d more not kept", r.Dropped)
+	}
+	b.WriteString(")")
+	if r.Fatal != nil {
+		fmt.Fprintf(&b, "; stopped: %v", r.Fatal)
+	}
+	return b.String()
+}
+
+// Unwrap lets errors.Is and errors.As look at every failure
+func (r *ErrorReport) Unwrap() []error {
+	errs := make([]error, 0, len(r.Items)+1)
+	if r.Fatal != nil {
+		errs = append(errs, r.Fatal)
+	}
+	for _, e := range r.Items {
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+type errorMode int
+
+const (
+	failFast errorMode = iota
+	skip
+)
+
+// ErrorStrategy decides what happens when a stage fails on an item
+type ErrorStrategy struct {
+	mode  errorMode
+	sink  func(*ItemError)
+	retry *workerpool.RetryPolicy
+}
+
+// FailFast cancels the whole pipeline on the first error (the default)
+func FailFast() ErrorStrategy {
+	return ErrorStrategy{mode: failFast}
+}
+
+// SkipAndCollect drops failed items, keeps going and reports every
+// failure from Wait
+func SkipAndCollect() ErrorStrategy {
+	return ErrorStrategy{mode: skip}
+}
+
+// RouteErrors is SkipAndCollect that also hands every failed item to sink.
+// sink may be called from several stages at once.
+func RouteErrors(sink func(*ItemError)) ErrorStrategy {
+	return ErrorStrategy{mode: skip, sink: sink}
+}
+
+// Retry runs a failing item again according to policy and falls back to
+// then once the policy gives up. Errors in Item carriers are not retried.
+func Retry(policy workerpool.RetryPolicy, then ErrorStrategy) ErrorStrategy {
+	then.retry = &policy
+	return then
+}
+
+// WithErrorStrategy sets the error strategy for every stage
+func WithErrorStrategy(s ErrorStrategy) Option {
+	return func(c *config) { c.errors = s }
+}
+
+// WithStageErrorStrategy overrides the error strategy of one stage
+func WithStageErrorStrategy(stage string, s ErrorStrategy) Option {
+	return func(c *config) {
+		if c.stageErrors == nil {
+			c.stageErrors = make(map[string]ErrorStrategy)
+		}
+		c.stageErrors[stage] = s
+	}
+}
+
+// WithMaxItemErrors keeps at most n failed items for the ErrorReport, so a
+// long-running pipeline that skips errors does not grow without bound;
+// later failures are only counted. The default is 1000, and a negative n
+// keeps every failure.
+func WithMaxItemErrors(n int) Option {
+	return func(c *config) { c.maxItemErrs = n }
+}
+
+func (p *Pipeline) strategy(stage string) ErrorStrategy {
+	if s, ok := p.cfg.stageErrors[stage]; ok {
+		return s
+	}
+	return p.cfg.errors
+}
+
+// attempt runs fn for one item under the stage's error strategy. It
+// returns false when the item should be dropped, and an error only when
+// the stage has to fail.
+func (p *Pipeline) attempt(ctx context.Context, stage string, m *stageMeter, item any, fn func() error) (bool, error) {
+	s := p.strategy(stage)
+	for n := 1; ; n++ {
+		start := time.Now()
+		err := safely(fn)
+		m.Observe(start)
+		if err == nil {
+			return true, nil
+		}
+		if s.retry == nil || n >= s.retry.MaxAttempts || !s.retry.ShouldRetry(err) {
+			return p.failed(stage, m, item, err, n)
+		}
+
+		timer := time.NewTimer(s.retry.Backoff(n))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false, nil
+		}
+	}
+}
+
+// failed applies the stage's error strategy to an item that failed for good
+func (p *Pipeline) failed(stage string, m *stageMeter, item any, err error, attempts int) (bool, error) {
+	s := p.strategy(stage)
+	if s.mode == failFast {
+		return false, err
+	}
+
+	ie := &ItemError{Stage: stage, Item: item, Err: err, Attempts: attempts}
+	m.Errors.Inc()
+	m.Dropped.Inc()
+	p.mu.Lock()
+	if p.cfg.maxItemErrs < 0 || len(p.itemErrs) < p.cfg.maxItemErrs {
+		p.itemErrs = append(p.itemErrs, ie)
+	} else {
+		p.errsDropped++
+	}
+	p.mu.Unlock()
+	if s.sink != nil {
+		s.sink(ie)
+	}
+	return false, nil
+}
+
+// Settle passes on the values of items and hands their errors to the
+// error strategy
+func Settle[T any](p *Pipeline, name string, in <-chan Item[T]) <-chan T {
+	out := make(chan T, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		for item := range receive(in, m) {
+			m.received()
+			if item.Err != nil {
+				if _, err := p.failed(name, m, item.Value, item.Err, 1); err != nil {
+					return err
+				}
+				p.done(1)
+				continue
+			}
+			if !send(ctx, p, out, item.Value, m) {
+				return nil
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return out
+}
@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+)
+
+// ErrMergerClosed is returned by Add once Close has been called or the
+// merger's context is done
+var ErrMergerClosed = errors.New("pipeline: merger closed")
+
+// Merger fans a changing set of channels into one. Inputs can be added
+// and removed while it runs. Out is closed once Close has been called and
+// every input has been closed or removed, or when ctx is done.
+//
+// Inputs have a priority, 0 unless added with AddPriority. A ready input
+// of higher priority is always read first, so it can starve lower ones;
+// among equal priorities the choice is random, so none of them starves.
+type Merger[T any] struct {
+	out  chan T
+	ops  chan mergeOp[T]
+	done chan struct{}
+}
+
+type mergeInput[T any] struct {
+	ch       <-chan T
+	priority int
+}
+
+type mergeOp[T any] struct {
+	kind  int // mergeAdd, mergeRemove or mergeClose
+	input mergeInput[T]
+	reply chan bool
+}
+
+const (
+	mergeAdd = iota
+	mergeRemove
+	mergeClose
+)
+
+// NewMerger starts a merger with no inputs
+func NewMerger[T any](ctx context.Context) *Merger[T] {
+	m := &Merger[T]{
+		out:  make(chan T),
+		ops:  make(chan mergeOp[T]),
+		done: make(chan struct{}),
+	}
+	go m.run(ctx)
+	return m
+}
+
+// Out returns the merged channel
+func (m *Merger[T]) Out() <-chan T {
+	return m.out
+}
+
+// Add starts reading in with priority 0
+func (m *Merger[T]) Add(in <-chan T) error {
+	return m.AddPriority(in, 0)
+}
+
+// AddPriority starts reading in. Higher priorities are read first.
+func (m *Merger[T]) AddPriority(in <-chan T, priority int) error {
+	if !m.do(mergeOp[T]{kind: mergeAdd, input: mergeInput[T]{in, priority}}) {
+		return ErrMergerClosed
+	}
+	return nil
+}
+
+// Remove stops reading in and reports whether it was an input. Once it
+// returns nothing more is read from in; an item already read is still
+// delivered.
+func (m *Merger[T]) Remove(in <-chan T) bool {
+	return m.do(mergeOp[T]{kind: mergeRemove, input: mergeInput[T]{ch: in}})
+}
+
+// Close says no more inputs will be added
+func (m *Merger[T]) Close() {
+	m.do(mergeOp[T]{kind: mergeClose})
+}
+
+func (m *Merger[T]) do(op mergeOp[T]) bool {
+	op.reply = make(chan bool, 1)
+	select {
+	case m.ops <- op:
+		return <-op.reply
+	case <-m.done:
+		return false
+	}
+}
+
+func (m *Merger[T]) run(ctx context.Context) {
+	defer close(m.done)
+	defer close(m.out)
+
+	var inputs []mergeInput[T] // highest priority first
+	closed := false
+
+	handle := func(op mergeOp[T]) {
+		switch op.kind {
+		case mergeAdd:
+			if closed {
+				op.reply <- false
+				return
+			}
+			// After the last input of the same priority or higher
+			i := slices.IndexFunc(inputs, func(in mergeInput[T]) bool { return in.priority < op.input.priority })
+			if i < 0 {
+				i = len(inputs)
+			}
+			inputs = slices.Insert(inputs, i, op.input)
+			op.reply <- true
+		case mergeRemove:
+			n := len(inputs)
+			inputs = slices.DeleteFunc(inputs, func(in mergeInput[T]) bool { return in.ch == op.input.ch })
+			op.reply <- len(inputs) < n
+		case mergeClose:
+			closed = true
+			op.reply <- true
+		}
+	}
+
+	// recv selects over inputs[lo:hi]. Without block it has a default
+	// case last; with block it also waits for ctx and then an op.
+	recv := func(lo, hi int, block bool) (int, reflect.Value, bool) {
+		cases := make([]reflect.SelectCase, 0, hi-lo+2)
+		for _, in := range inputs[lo:hi] {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in.ch)})
+		}
+		if block {
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(m.ops)})
+		} else {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+		}
+		return reflect.Select(cases)
+	}
+
+next:
+	for !closed || len(inputs) > 0 {
+		var item T
+		got := false
+
+		// With several priorities, try each one in turn before waiting
+		if len(inputs) > 1 && inputs[0].priority != inputs[len(inputs)-1].priority {
+			for lo := 0; lo < len(inputs) && !got; {
+				hi := lo + 1
+				for hi < len(inputs) && inputs[hi].priority == inputs[lo].priority {
+					hi++
+				}
+				chosen, v, ok := recv(lo, hi, false)
+				switch {
+				case chosen == hi-lo:
+					lo = hi // nothing ready at this priority
+				case !ok:
+					inputs = slices.Delete(inputs, lo+chosen, lo+chosen+1)
+					continue next
+				default:
+					item, _ = v.Interface().(T)
+					got = true
+				}
+			}
+		}
+
+		if !got {
+			n := len(inputs)
+			chosen, v, ok := recv(0, n, true)
+			switch {
+			case chosen == n:
+				return
+			case chosen == n+1:
+				handle(v.Interface().(mergeOp[T]))
+				continue
+			case !ok:
+				inputs = slices.Delete(inputs, chosen, chosen+1)
+				continue
+			}
+			item, _ = v.Interface().(T)
+		}
+
+		// Keep serving Add and Remove while out is full
+		for {
+			select {
+			case m.out <- item:
+				continue next
+			case op := <-m.ops:
+				handle(op)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Merge interleaves several channels into one. It is a Merger over a
+// fixed set of inputs, so see NewMerger to add or remove them while the
+// pipeline runs.
+func Merge[T any](p *Pipeline, name string, ins ...<-chan T) <-chan T {
+	out := make(chan T, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		merged := NewMerger[T](ctx)
+		for _, in := range ins {
+			merged.Add(in)
+		}
+		merged.Close()
+
+		for item := range receive(merged.Out(), m) {
+			m.received()
+			if !send(ctx, p, out, item, m) {
+				return nil
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return out
+}
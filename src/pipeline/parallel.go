@@ -0,0 +1,128 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// ParallelMap is Map running fn on up to workers items at once. Outputs
+// are sent in input order: a result that finishes early waits in a reorder
+// buffer until everything before it has been sent. At most reorderLimit
+// results wait there; once it is full no new item is started until the
+// oldest one finishes, so one slow item cannot make memory grow without
+// bound.
+func ParallelMap[In, Out any](p *Pipeline, name string, in <-chan In, workers, reorderLimit int, fn func(ctx context.Context, item In) (Out, error)) <-chan Out {
+	workers = max(workers, 1)
+	reorderLimit = max(reorderLimit, 0)
+
+	out := make(chan Out, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		m.workers.Store(int64(workers))
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		type task struct {
+			seq  int
+			item In
+		}
+		type result struct {
+			seq   int
+			value Out
+			ok    bool // false if the item failed and was skipped
+		}
+		tasks := make(chan task)
+		results := make(chan result, workers)
+		// A slot is held from the moment an item is started until its
+		// output has been sent, which is what bounds the reorder buffer
+		slots := make(chan struct{}, workers+reorderLimit)
+
+		var mu sync.Mutex
+		var firstErr error
+		failed := func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(tasks)
+			seq := 0
+			for item := range in {
+				m.received()
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case tasks <- task{seq, item}:
+				case <-ctx.Done():
+					return
+				}
+				seq++
+			}
+		}()
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range receive(tasks, m) {
+					var v Out
+					ok, err := p.attempt(ctx, name, m, t.item, func() (err error) {
+						v, err = fn(ctx, t.item)
+						return err
+					})
+					if err != nil {
+						failed(err)
+						return
+					}
+					select {
+					case results <- result{t.seq, v, ok}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		// Resequence: hold results until the next one in input order arrives
+		pending := make(map[int]result)
+		next := 0
+		for r := range results {
+			pending[r.seq] = r
+			for ctx.Err() == nil {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				if r.ok && !send(ctx, p, out, r.value, m) {
+					cancel() // keep draining results until the workers exit
+					break
+				}
+				p.done(1)
+				<-slots
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	})
+	return out
+}
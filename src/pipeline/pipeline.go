@@ -0,0 +1,477 @@
+// Package pipeline builds channel pipelines out of small generic stages.
+//
+// Every stage runs in its own goroutine owned by a Pipeline. When a stage
+// fails, or the context is cancelled, the whole pipeline is cancelled,
+// every goroutine exits and Wait reports the first error:
+//
+//	p := pipeline.New(ctx)
+//	nums := pipeline.FromSlice(p, 1, 2, 3, 4, 5)
+//	doubled := pipeline.Map(p, "double", nums, func(ctx context.Context, n int) (int, error) {
+//		return n * 2, nil
+//	})
+//	pipeline.Sink(p, "print", doubled, func(ctx context.Context, n int) error {
+//		fmt.Println(n)
+//		return nil
+//	})
+//	err := p.Wait()
+//
+// A caller that reads the last channel itself instead of using Sink must
+// either read it until it is closed or call Stop, then call Wait.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+)
+
+// ErrPanic wraps a panic recovered in a stage function
+var ErrPanic = errors.New("pipeline: stage panicked")
+
+// ErrStopped is the cancellation cause when Stop is called
+var ErrStopped = errors.New("pipeline: stopped")
+
+// StageError is the error a stage failed with
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("pipeline: stage %q: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Option configures a Pipeline
+type Option func(*config)
+
+type config struct {
+	buffer      int
+	buffers     map[string]int
+	checkpoints *Checkpoints
+	every       time.Duration
+	registry    *metrics.Registry
+	name        string
+	errors      ErrorStrategy
+	stageErrors map[string]ErrorStrategy
+	maxItemErrs int
+}
+
+// WithBuffer sets the buffer size of the channels between stages
+func WithBuffer(n int) Option {
+	return func(c *config) { c.buffer = n }
+}
+
+// WithStageBuffer overrides the buffer size of one stage's output channel
+func WithStageBuffer(stage string, n int) Option {
+	return func(c *config) {
+		if c.buffers == nil {
+			c.buffers = make(map[string]int)
+		}
+		c.buffers[stage] = n
+	}
+}
+
+// WithMetrics records per-stage metrics in reg, labelled pipeline=name
+func WithMetrics(reg *metrics.Registry, name string) Option {
+	return func(c *config) {
+		c.registry = reg
+		c.name = name
+	}
+}
+
+// Pipeline owns the goroutines of a set of connected stages
+type Pipeline struct {
+	cfg    config
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+
+	mu          sync.Mutex
+	err         error
+	itemErrs    []*ItemError
+	errsDropped int // failures beyond cfg.maxItemErrs
+	stages      []*stageMeter
+
+	// Checkpointing: sources emit under gate's read lock, and inflight
+	// counts items sent on a channel and not yet fully handled
+	gate     sync.RWMutex
+	inflight atomic.Int64
+	states   map[string]*stageState
+	cpDone   chan struct{}
+}
+
+// New returns an empty pipeline. Cancelling ctx stops every stage.
+func New(ctx context.Context, opts ...Option) *Pipeline {
+	cfg := config{maxItemErrs: 1000}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	p := &Pipeline{cfg: cfg, ctx: ctx, cancel: cancel, states: make(map[string]*stageState)}
+	if cfg.checkpoints != nil {
+		p.cpDone = make(chan struct{})
+	}
+	return p
+}
+
+// Context returns the context stages run with. It is cancelled when the
+// pipeline fails or is stopped.
+func (p *Pipeline) Context() context.Context {
+	return p.ctx
+}
+
+// Stop cancels every stage
+func (p *Pipeline) Stop() {
+	p.fail(ErrStopped)
+}
+
+// Wait blocks until every stage has exited. It returns nil if the
+// pipeline ran to completion, an *ErrorReport if items failed under a
+// skipping error strategy, and otherwise the error that stopped it.
+func (p *Pipeline) Wait() error {
+	p.wg.Wait()
+	p.finishCheckpoints()
+	p.cancel(nil) // release the context; keeps the first cause if any
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.itemErrs) > 0 || p.errsDropped > 0 {
+		return &ErrorReport{Fatal: p.err, Items: p.itemErrs, Dropped: p.errsDropped}
+	}
+	return p.err
+}
+
+func (p *Pipeline) buffer(stage string) int {
+	if n, ok := p.cfg.buffers[stage]; ok {
+		return n
+	}
+	return p.cfg.buffer
+}
+
+// fail records the first error and cancels the pipeline
+func (p *Pipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.cancel(err)
+	}
+}
+
+// spawn runs one stage in its own goroutine
+func (p *Pipeline) spawn(name string, run func(ctx context.Context, m *stageMeter) error) {
+	m := &stageMeter{Stage: &metrics.Stage{}, name: name}
+	if p.cfg.registry != nil {
+		m.Stage = p.cfg.registry.Stage(p.cfg.name, name)
+	}
+	p.mu.Lock()
+	p.stages = append(p.stages, m)
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		m.started.Store(time.Now().UnixNano())
+		err := safely(func() error { return run(p.ctx, m) })
+		m.stopped.Store(time.Now().UnixNano())
+
+		switch {
+		case p.ctx.Err() != nil:
+			// Stopped along with everything else; report why
+			p.fail(context.Cause(p.ctx))
+		case err != nil:
+			m.Errors.Inc()
+			p.fail(&StageError{Stage: name, Err: err})
+		}
+	}()
+}
+
+// safely turns a panic in fn into an error
+func safely(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrPanic, r)
+		}
+	}()
+	return fn()
+}
+
+// send delivers v unless the pipeline is cancelled first. v counts as in
+// flight until the stage that receives it calls done.
+func send[T any](ctx context.Context, p *Pipeline, out chan<- T, v T, m *stageMeter) bool {
+	p.inflight.Add(1)
+	m.sending(len(out), cap(out))
+	select {
+	case out <- v:
+		m.sent(0)
+		return true
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case out <- v:
+		m.sent(time.Since(start))
+		return true
+	case <-ctx.Done():
+		p.inflight.Add(-1)
+		return false
+	}
+}
+
+// done marks n received items as fully handled
+func (p *Pipeline) done(n int) {
+	p.inflight.Add(int64(-n))
+}
+
+// Source runs gen in its own stage. emit returns an error once the
+// pipeline has been cancelled; gen should return it.
+func Source[T any](p *Pipeline, name string, gen func(ctx context.Context, emit func(T) error) error) <-chan T {
+	return source(p, name, gen, nil)
+}
+
+// source is Source with a hook called after each item is sent, before a
+// checkpoint can be taken
+func source[T any](p *Pipeline, name string, gen func(ctx context.Context, emit func(T) error) error, sent func()) <-chan T {
+	out := make(chan T, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		start := time.Now() // producing the next item counts as busy
+		defer func() { m.Observe(start) }()
+		return gen(ctx, func(v T) error {
+			m.Observe(start)
+			defer func() { start = time.Now() }()
+
+			// A checkpoint holds the gate while it waits for the
+			// pipeline to drain
+			p.gate.RLock()
+			defer p.gate.RUnlock()
+			if !send(ctx, p, out, v, m) {
+				return context.Cause(ctx)
+			}
+			if sent != nil {
+				sent()
+			}
+			return nil
+		})
+	})
+	return out
+}
+
+// FromSlice emits items in order
+func FromSlice[T any](p *Pipeline, items ...T) <-chan T {
+	return Source(p, "source", func(ctx context.Context, emit func(T) error) error {
+		for _, item := range items {
+			if err := emit(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Map applies fn to every item. What an error from fn does depends on the
+// error strategy; by default it fails the pipeline.
+func Map[In, Out any](p *Pipeline, name string, in <-chan In, fn func(ctx context.Context, item In) (Out, error)) <-chan Out {
+	out := make(chan Out, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		for item := range receive(in, m) {
+			m.received()
+			var v Out
+			ok, err := p.attempt(ctx, name, m, item, func() (err error) {
+				v, err = fn(ctx, item)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if ok && !send(ctx, p, out, v, m) {
+				return nil
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return out
+}
+
+// Filter passes on the items keep returns true for
+func Filter[T any](p *Pipeline, name string, in <-chan T, keep func(item T) bool) <-chan T {
+	out := make(chan T, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		for item := range receive(in, m) {
+			m.received()
+			start := time.Now()
+			ok := keep(item)
+			m.Observe(start)
+			if ok && !send(ctx, p, out, item, m) {
+				return nil
+			}
+			if !ok {
+				m.Dropped.Inc()
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return out
+}
+
+// FlatMap turns every item into zero or more items
+func FlatMap[In, Out any](p *Pipeline, name string, in <-chan In, fn func(ctx context.Context, item In) ([]Out, error)) <-chan Out {
+	out := make(chan Out, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		for item := range receive(in, m) {
+			m.received()
+			var vs []Out
+			_, err := p.attempt(ctx, name, m, item, func() (err error) {
+				vs, err = fn(ctx, item)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, v := range vs {
+				if !send(ctx, p, out, v, m) {
+					return nil
+				}
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return out
+}
+
+// Batch groups items into slices of up to size items. A partial batch is
+// sent once maxWait has passed since its first item (zero means wait for
+// a full batch) and when the input closes. The partial batch is part of
+// the checkpointed state.
+func Batch[T any](p *Pipeline, name string, in <-chan T, size int, maxWait time.Duration) <-chan []T {
+	if size < 1 {
+		size = 1
+	}
+	out := make(chan []T, p.buffer(name))
+	var batch []T
+	mu := p.stateful(name, &batch)
+
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		startTimer := func() {
+			if maxWait > 0 {
+				timer = time.NewTimer(maxWait)
+				expired = timer.C
+			}
+		}
+		// flush is called with mu held
+		flush := func() bool {
+			if timer != nil {
+				timer.Stop()
+				timer, expired = nil, nil
+			}
+			if len(batch) == 0 {
+				return true
+			}
+			b := batch
+			batch = nil
+			return send(ctx, p, out, b, m)
+		}
+
+		if len(batch) > 0 {
+			startTimer() // restored from a checkpoint
+		}
+		for {
+			// Waiting for the timer is waiting for input too
+			start := time.Now()
+			select {
+			case item, ok := <-in:
+				m.waited(start)
+				mu.Lock()
+				if !ok {
+					flush()
+					mu.Unlock()
+					return nil
+				}
+				m.received()
+				batch = append(batch, item)
+				p.done(1) // the item is part of the stage's state now
+				if len(batch) == 1 {
+					startTimer()
+				}
+				sent := len(batch) < size || flush()
+				mu.Unlock()
+				if !sent {
+					return nil
+				}
+			case <-expired:
+				m.waited(start)
+				mu.Lock()
+				sent := flush()
+				mu.Unlock()
+				if !sent {
+					return nil
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	return out
+}
+
+// Tap calls fn for every item and passes it on unchanged
+func Tap[T any](p *Pipeline, name string, in <-chan T, fn func(item T)) <-chan T {
+	out := make(chan T, p.buffer(name))
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		for item := range receive(in, m) {
+			m.received()
+			start := time.Now()
+			fn(item)
+			m.Observe(start)
+			if !send(ctx, p, out, item, m) {
+				return nil
+			}
+			p.done(1)
+		}
+		return nil
+	})
+	return out
+}
+
+// Sink consumes every item with fn. Call Wait to know when it is done.
+func Sink[T any](p *Pipeline, name string, in <-chan T, fn func(ctx context.Context, item T) error) {
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		for {
+			start := time.Now()
+			select {
+			case item, ok := <-in:
+				m.waited(start)
+				if !ok {
+					return nil
+				}
+				m.received()
+				if _, err := p.attempt(ctx, name, m, item, func() error { return fn(ctx, item) }); err != nil {
+					return err
+				}
+				p.done(1)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+}
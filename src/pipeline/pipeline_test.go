@@ -0,0 +1,762 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"workerpool"
+)
+
+func TestStagesCompose(t *testing.T) {
+	p := New(context.Background())
+	nums := FromSlice(p, 1, 2, 3, 4, 5)
+	doubled := Map(p, "double", nums, func(ctx context.Context, n int) (int, error) { return n * 2, nil })
+	big := Filter(p, "big", doubled, func(n int) bool { return n > 4 })
+	pairs := FlatMap(p, "pair", big, func(ctx context.Context, n int) ([]int, error) { return []int{n, -n}, nil })
+	seen := 0
+	tapped := Tap(p, "count", pairs, func(int) { seen++ })
+	batches := Batch(p, "batch", tapped, 4, 0)
+
+	var got [][]int
+	Sink(p, "collect", batches, func(ctx context.Context, b []int) error {
+		got = append(got, b)
+		return nil
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]int{{6, -6, 8, -8}, {10, -10}}
+	if !slices.EqualFunc(got, want, slices.Equal[[]int]) || seen != 6 {
+		t.Errorf("got %v (tapped %d); expected %v", got, seen, want)
+	}
+}
+
+func TestErrorCancelsWithoutLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+	boom := errors.New("boom")
+
+	p := New(context.Background())
+	endless := Source(p, "endless", func(ctx context.Context, emit func(int) error) error {
+		for i := 0; ; i++ {
+			if err := emit(i); err != nil {
+				return err
+			}
+		}
+	})
+	failing := Map(p, "fail", endless, func(ctx context.Context, n int) (int, error) {
+		if n == 100 {
+			return 0, boom
+		}
+		return n, nil
+	})
+	Sink(p, "discard", failing, func(ctx context.Context, n int) error { return nil })
+
+	err := p.Wait()
+	var se *StageError
+	if !errors.Is(err, boom) || !errors.As(err, &se) || se.Stage != "fail" {
+		t.Fatalf("got %v; expected boom from stage fail", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines leaked", n-before)
+	}
+}
+
+func TestPanicAndStop(t *testing.T) {
+	p := New(context.Background())
+	nums := FromSlice(p, 1, 2, 3)
+	Sink(p, "explode", nums, func(ctx context.Context, n int) error { panic("bad item") })
+	if err := p.Wait(); !errors.Is(err, ErrPanic) {
+		t.Errorf("got %v; expected ErrPanic", err)
+	}
+
+	p = New(context.Background())
+	ticks := Source(p, "ticks", func(ctx context.Context, emit func(int) error) error {
+		for {
+			if err := emit(1); err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	batches := Batch(p, "batch", ticks, 1000, 20*time.Millisecond)
+	<-batches // flushed by time, not size
+	p.Stop()
+	if err := p.Wait(); !errors.Is(err, ErrStopped) {
+		t.Errorf("got %v; expected ErrStopped", err)
+	}
+}
+
+func TestParallelMapKeepsOrder(t *testing.T) {
+	p := New(context.Background())
+	items := make([]int, 50)
+	for i := range items {
+		items[i] = i
+	}
+	nums := FromSlice(p, items...)
+
+	var mu sync.Mutex
+	started, startedBeforeSlow := 0, 0
+	squares := ParallelMap(p, "square", nums, 4, 3, func(ctx context.Context, n int) (int, error) {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		if n == 0 {
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			startedBeforeSlow = started
+			mu.Unlock()
+		} else {
+			time.Sleep(time.Duration(rand.IntN(3)) * time.Millisecond)
+		}
+		return n * n, nil
+	})
+
+	var got []int
+	Sink(p, "collect", squares, func(ctx context.Context, n int) error {
+		got = append(got, n)
+		return nil
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, n := range got {
+		if n != i*i {
+			t.Fatalf("output %d is %d; expected %d (got %v)", i, n, i*i, got)
+		}
+	}
+	if len(got) != len(items) {
+		t.Errorf("got %d outputs; expected %d", len(got), len(items))
+	}
+	// The slow first item may only be overtaken by workers+reorderLimit-1 items
+	if startedBeforeSlow > 4+3 {
+		t.Errorf("%d items started while the first was still running; limit is 7", startedBeforeSlow)
+	}
+}
+
+type reading struct {
+	at    time.Time
+	name  string
+	value float64
+}
+
+func collectPanes(t *testing.T, items []reading, w Windowing, opts ...WindowOption[reading]) ([]Pane[reading], []reading) {
+	t.Helper()
+	var late []reading
+	opts = append(opts,
+		WithEventTime(func(r reading) time.Time { return r.at }),
+		WithLateItems(func(r reading) { late = append(late, r) }))
+
+	p := New(context.Background())
+	panes := Window(p, "window", FromSlice(p, items...), w, opts...)
+	var got []Pane[reading]
+	Sink(p, "collect", panes, func(ctx context.Context, pane Pane[reading]) error {
+		got = append(got, pane)
+		return nil
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return got, late
+}
+
+func TestWindows(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s float64) time.Time { return t0.Add(time.Duration(s * float64(time.Second))) }
+	values := func(pane Pane[reading]) []float64 {
+		var vs []float64
+		for _, r := range pane.Items {
+			vs = append(vs, r.value)
+		}
+		return vs
+	}
+
+	// 1s tumbling windows, 500ms allowed lateness: the item at 0.8s arrives
+	// after 1.2s but is still in time; the one at 0.1s after 2.1s is late
+	items := []reading{
+		{at(0.1), "a", 1}, {at(0.5), "a", 2}, {at(1.2), "a", 3}, {at(0.8), "a", 4},
+		{at(2.1), "a", 5}, {at(0.1), "a", 6},
+	}
+	panes, late := collectPanes(t, items, Tumbling(time.Second), WithAllowedLateness[reading](500*time.Millisecond))
+	if len(panes) != 3 || !slices.Equal(values(panes[0]), []float64{1, 2, 4}) ||
+		!slices.Equal(values(panes[1]), []float64{3}) || len(late) != 1 || late[0].value != 6 {
+		t.Errorf("tumbling: panes %v, late %v", panes, late)
+	}
+
+	// Sliding 2s windows every 1s, per key
+	items = []reading{{at(0.5), "a", 1}, {at(1.5), "b", 2}, {at(1.6), "a", 3}}
+	panes, _ = collectPanes(t, items, Sliding(2*time.Second, time.Second),
+		WithKey(func(r reading) string { return r.name }))
+	sums := map[string][]float64{}
+	for _, pane := range panes {
+		sums[pane.Key] = append(sums[pane.Key], pane.Summary(func(r reading) float64 { return r.value }).Sum)
+	}
+	if !slices.Equal(sums["a"], []float64{1, 4, 3}) || !slices.Equal(sums["b"], []float64{2, 2}) {
+		t.Errorf("sliding sums %v", sums)
+	}
+
+	// 1s windows every 2s leave gaps; an item in one is dropped, not late
+	items = []reading{{at(0.5), "a", 1}, {at(1.5), "a", 2}, {at(2.5), "a", 3}}
+	panes, late = collectPanes(t, items, Sliding(time.Second, 2*time.Second))
+	if len(panes) != 2 || !slices.Equal(values(panes[1]), []float64{3}) || len(late) != 0 {
+		t.Errorf("sliding with gaps: panes %v, late %v", panes, late)
+	}
+	for name, bad := range map[string]Windowing{
+		"tumbling 0":    Tumbling(0),
+		"sliding 0":     Sliding(time.Second, 0),
+		"negative size": Sliding(-time.Second, time.Second),
+		"session gap 0": Session(0),
+	} {
+		p := New(context.Background())
+		Sink(p, "collect", Window(p, "window", FromSlice(p, items...), bad),
+			func(context.Context, Pane[reading]) error { return nil })
+		if err := p.Wait(); !errors.Is(err, ErrBadWindow) {
+			t.Errorf("%s: Wait = %v; expected ErrBadWindow", name, err)
+		}
+	}
+
+	// Sessions split on a 1s gap; the late item at 2.2s joins the second one
+	items = []reading{{at(0), "a", 1}, {at(0.6), "a", 2}, {at(3), "a", 3}, {at(3.5), "a", 4}, {at(2.2), "a", 5}}
+	panes, _ = collectPanes(t, items, Session(time.Second), WithAllowedLateness[reading](2*time.Second))
+	if len(panes) != 2 || !slices.Equal(values(panes[0]), []float64{1, 2}) || !slices.Equal(values(panes[1]), []float64{3, 4, 5}) {
+		t.Errorf("sessions %v", panes)
+	}
+
+	// Last 3 items every 2 items, then the leftover at the end
+	items = []reading{{at(0), "a", 1}, {at(1), "a", 2}, {at(2), "a", 3}, {at(3), "a", 4}, {at(4), "a", 5}}
+	panes, _ = collectPanes(t, items, SlidingCount(3, 2))
+	if len(panes) != 3 || !slices.Equal(values(panes[1]), []float64{2, 3, 4}) || !slices.Equal(values(panes[2]), []float64{3, 4, 5}) {
+		t.Errorf("count windows %v", panes)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	s := Summarize([]float64{5, 1, 4, 2, 3})
+	if s.Count != 5 || s.Sum != 15 || s.Min != 1 || s.Max != 5 || s.Mean() != 3 {
+		t.Errorf("summary %+v", s)
+	}
+	if p := s.Percentile(50); p != 3 {
+		t.Errorf("p50 = %v", p)
+	}
+	if p := s.Percentile(90); p != 4.6 {
+		t.Errorf("p90 = %v", p)
+	}
+}
+
+func TestErrorStrategies(t *testing.T) {
+	bad := errors.New("bad item")
+	run := func(opts ...Option) ([]int, error) {
+		p := New(context.Background(), opts...)
+		nums := FromSlice(p, 1, 2, 3, 4, 5, 6)
+		var mu sync.Mutex
+		attempts := map[int]int{}
+		doubled := ParallelMap(p, "double", nums, 2, 2, func(ctx context.Context, n int) (int, error) {
+			mu.Lock()
+			attempts[n]++
+			tries := attempts[n]
+			mu.Unlock()
+			if n == 3 && tries < 2 {
+				return 0, errors.New("flaky")
+			}
+			if n == 5 {
+				return 0, workerpool.Permanent(bad)
+			}
+			return n * 2, nil
+		})
+		var got []int
+		Sink(p, "collect", doubled, func(ctx context.Context, n int) error {
+			if n == 8 {
+				panic("eight")
+			}
+			got = append(got, n)
+			return nil
+		})
+		return got, p.Wait()
+	}
+
+	// Fail fast: the flaky first attempt of item 3 stops everything
+	var se *StageError
+	if _, err := run(); !errors.As(err, &se) || se.Stage != "double" {
+		t.Errorf("fail-fast: got %v; expected a StageError from double", err)
+	}
+
+	var routed []*ItemError
+	got, err := run(WithErrorStrategy(RouteErrors(func(e *ItemError) { routed = append(routed, e) })),
+		WithStageErrorStrategy("double", Retry(workerpool.RetryPolicy{MaxAttempts: 3}, SkipAndCollect())))
+	var report *ErrorReport
+	if !errors.As(err, &report) || report.Fatal != nil || len(report.Items) != 2 {
+		t.Fatalf("got %v; expected a report with 2 items", err)
+	}
+	if !errors.Is(err, bad) || !errors.Is(err, ErrPanic) {
+		t.Errorf("report %v does not wrap both failures", err)
+	}
+	if !slices.Equal(got, []int{2, 4, 6, 12}) {
+		t.Errorf("got %v; expected [2 4 6 12]", got)
+	}
+	// Only the sink uses RouteErrors; the map stage just collects
+	if len(routed) != 1 || routed[0].Stage != "collect" || routed[0].Item != 8 {
+		t.Errorf("routed %v", routed)
+	}
+	for _, e := range report.Items {
+		if e.Stage == "double" && e.Attempts != 1 {
+			t.Errorf("item 5 failed permanently but was attempted %d times", e.Attempts)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	p := New(context.Background(), WithErrorStrategy(SkipAndCollect()))
+	items := FromSlice(p, Item[int]{Value: 1}, Item[int]{Err: errors.New("unreadable")}, Item[int]{Value: 3})
+	var got []int
+	Sink(p, "collect", Settle(p, "settle", items), func(ctx context.Context, n int) error {
+		got = append(got, n)
+		return nil
+	})
+	var report *ErrorReport
+	if err := p.Wait(); !errors.As(err, &report) || len(report.Items) != 1 || !slices.Equal(got, []int{1, 3}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+
+	// Past the limit failures are only counted
+	p = New(context.Background(), WithErrorStrategy(SkipAndCollect()), WithMaxItemErrors(2))
+	bad := make([]Item[int], 5)
+	for i := range bad {
+		bad[i].Err = errors.New("unreadable")
+	}
+	Sink(p, "collect", Settle(p, "settle", FromSlice(p, bad...)), func(context.Context, int) error { return nil })
+	err := p.Wait()
+	if !errors.As(err, &report) || len(report.Items) != 2 || report.Dropped != 3 ||
+		err.Error() != "pipeline: 5 items failed (settle: 2, 3 more not kept)" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	written := map[int]int{} // item -> running total when it was written
+	dupes := 0
+
+	run := func(stopAfter int) error {
+		cp, err := OpenCheckpoints(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := New(context.Background(), WithCheckpoints(cp, 5*time.Millisecond))
+		nums := ResumableSource(p, "nums", func(ctx context.Context, offset int64, emit func(int) error) error {
+			for n := int(offset); n < 100; n++ {
+				if err := emit(n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		type total struct{ N, Sum int }
+		totals := StatefulMap(p, "sum", nums, func(ctx context.Context, sum *int, n int) (total, error) {
+			*sum += n
+			return total{n, *sum}, nil
+		})
+		batches := Batch(p, "batch", totals, 7, 0)
+		items := FlatMap(p, "items", batches, func(ctx context.Context, b []total) ([]total, error) { return b, nil })
+		DedupeSink(p, "write", items, func(t total) string { return strconv.Itoa(t.N) }, func(ctx context.Context, t total) error {
+			time.Sleep(200 * time.Microsecond)
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := written[t.N]; ok {
+				dupes++
+			}
+			written[t.N] = t.Sum
+			if len(written) == stopAfter {
+				p.Stop()
+			}
+			return nil
+		})
+		return p.Wait()
+	}
+
+	if err := run(60); !errors.Is(err, ErrStopped) {
+		t.Fatalf("first run: %v", err)
+	}
+	cp, err := OpenCheckpoints(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Saved().IsZero() {
+		t.Fatal("no checkpoint taken during the first run")
+	}
+
+	if err := run(-1); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if len(written) != 100 || dupes != 0 {
+		t.Fatalf("wrote %d items with %d duplicates, want 100 and 0", len(written), dupes)
+	}
+	for n, sum := range written {
+		if sum != n*(n+1)/2 {
+			t.Fatalf("running total at %d = %d, want %d", n, sum, n*(n+1)/2)
+		}
+	}
+
+	// A finished run leaves a final checkpoint; running again does nothing
+	before := len(written)
+	if err := run(-1); err != nil || len(written) != before || dupes != 0 {
+		t.Fatalf("rerun: err %v, %d items, %d duplicates", err, len(written), dupes)
+	}
+}
+
+func TestWindowStateRoundTrip(t *testing.T) {
+	base := time.Unix(1000, 0)
+	ws := &windows[int]{w: Tumbling(time.Second), panes: map[paneID]*Pane[int]{}, recent: map[string]*countPane[int]{}}
+	ws.add("a", base.Add(100*time.Millisecond), 1, time.Time{})
+	ws.add("a", base.Add(1200*time.Millisecond), 2, time.Time{})
+	ws.watermark = base
+
+	data, err := json.Marshal(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &windows[int]{w: Tumbling(time.Second), panes: map[paneID]*Pane[int]{}, recent: map[string]*countPane[int]{}}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.watermark.Equal(base) || len(restored.panes) != 2 {
+		t.Fatalf("restored watermark %v with %d panes", restored.watermark, len(restored.panes))
+	}
+
+	// An item for a restored pane joins it instead of opening a new one
+	restored.add("a", base.Add(500*time.Millisecond), 3, restored.watermark)
+	panes := restored.fire(base.Add(time.Second), false)
+	if len(panes) != 1 || !slices.Equal(panes[0].Items, []int{1, 3}) {
+		t.Fatalf("fired %v", panes)
+	}
+}
+
+func TestStatsFindBottleneck(t *testing.T) {
+	p := New(context.Background())
+	nums := Source(p, "nums", func(ctx context.Context, emit func(int) error) error {
+		for i := 0; i < 30; i++ {
+			if err := emit(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	slow := Map(p, "slow", nums, func(ctx context.Context, n int) (int, error) {
+		time.Sleep(4 * time.Millisecond)
+		return n, nil
+	})
+	fast := ParallelMap(p, "fast", slow, 2, 0, func(ctx context.Context, n int) (int, error) {
+		time.Sleep(time.Millisecond)
+		return n, nil
+	})
+	Sink(p, "drop", fast, func(ctx context.Context, n int) error { return nil })
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := p.Stats()
+	names := make([]string, len(stats))
+	for i, s := range stats {
+		names[i] = s.Name
+	}
+	if !slices.Equal(names, []string{"nums", "slow", "fast", "drop"}) {
+		t.Fatalf("stages %v", names)
+	}
+	if s := stats[1]; s.In != 30 || s.Out != 30 || s.Utilisation < 0.5 {
+		t.Fatalf("slow stage: %+v", s)
+	}
+	if stats[0].SendWait < 50*time.Millisecond {
+		t.Fatalf("source waited %v to send to the slow stage", stats[0].SendWait)
+	}
+	if stats[2].Workers != 2 || stats[2].RecvWait < stats[2].Busy {
+		t.Fatalf("fast stage: %+v", stats[2])
+	}
+	// Receives are timed: the sink waits on the slow stage, which itself
+	// hardly waits for the source
+	if stats[3].RecvWait < 50*time.Millisecond || stats[1].RecvWait > stats[1].Busy/4 {
+		t.Fatalf("receive waits: sink %v, slow stage %v", stats[3].RecvWait, stats[1].RecvWait)
+	}
+
+	r := AnalyzeStats(stats)
+	// slow needs 4ms per item against fast's 2 workers at 1ms: 8 workers
+	if r.Bottleneck != "slow" || r.Suggested < 5 || r.Suggested > 12 {
+		t.Fatalf("bottleneck %q, suggested %d workers", r.Bottleneck, r.Suggested)
+	}
+}
+
+func TestMerger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fill := func(vals ...int) chan int {
+		ch := make(chan int, len(vals))
+		for _, v := range vals {
+			ch <- v
+		}
+		return ch
+	}
+
+	// Higher priorities drain first while they have items ready
+	m := NewMerger[int](ctx)
+	low, high := fill(1, 2, 3), fill(10, 20, 30)
+	m.AddPriority(high, 1)
+	m.Add(low)
+	close(high)
+	var got []int
+	for i := 0; i < 3; i++ {
+		got = append(got, <-m.Out())
+	}
+	if !slices.Equal(got, []int{10, 20, 30}) {
+		t.Fatalf("read %v before the low priority input", got)
+	}
+
+	// Inputs come and go; Out stays open until Close and the last input
+	late := make(chan int)
+	if err := m.Add(late); err != nil {
+		t.Fatal(err)
+	}
+	go func() { late <- 100 }()
+	for len(got) < 7 {
+		got = append(got, <-m.Out())
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []int{1, 2, 3, 10, 20, 30, 100}) {
+		t.Fatalf("merged %v", got)
+	}
+	if !m.Remove(low) || m.Remove(low) {
+		t.Fatal("Remove should report whether the channel was an input")
+	}
+
+	m.Close()
+	if err := m.Add(make(chan int)); !errors.Is(err, ErrMergerClosed) {
+		t.Fatalf("Add after Close: %v", err)
+	}
+	select {
+	case v, ok := <-m.Out():
+		t.Fatalf("Out gave %v, %v while an input is open", v, ok)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(late)
+	if _, ok := <-m.Out(); ok {
+		t.Fatal("Out still open after the last input closed")
+	}
+}
+
+func TestMergeStage(t *testing.T) {
+	p := New(context.Background())
+	a := FromSlice(p, 1, 2, 3)
+	b := Source(p, "b", func(ctx context.Context, emit func(int) error) error {
+		for _, v := range []int{4, 5, 6} {
+			if err := emit(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var got []int
+	Sink(p, "collect", Merge(p, "merge", a, b), func(ctx context.Context, n int) error {
+		got = append(got, n)
+		return nil
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []int{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("merged %v", got)
+	}
+}
+
+func TestBroadcaster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan int)
+	b := NewBroadcaster(ctx, in)
+
+	all, _ := b.Subscribe(0, Block)
+	lossy, _ := b.Subscribe(1, Drop)
+	cut, _ := b.Subscribe(1, Disconnect)
+
+	var got []int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := range all.C {
+			got = append(got, v)
+		}
+	}()
+
+	for i := 1; i <= 3; i++ {
+		in <- i
+	}
+	// A subscriber joining late only sees what comes after
+	late, err := b.Subscribe(5, Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in <- 4
+	if v := <-late.C; v != 4 {
+		t.Fatalf("late subscriber got %d", v)
+	}
+	late.Close()
+	in <- 5
+	close(in)
+	<-done
+
+	if !slices.Equal(got, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("blocking subscriber got %v", got)
+	}
+	if v := <-lossy.C; v != 1 || lossy.Dropped() != 4 {
+		t.Fatalf("dropping subscriber got %d first and dropped %d", v, lossy.Dropped())
+	}
+	if v := <-cut.C; v != 1 || !errors.Is(cut.Err(), ErrSlowSubscriber) {
+		t.Fatalf("disconnected subscriber got %d, err %v", v, cut.Err())
+	}
+	if _, ok := <-cut.C; ok {
+		t.Fatal("disconnected subscription still open")
+	}
+	if v, ok := <-late.C; ok {
+		t.Fatalf("late subscriber got %d after leaving", v)
+	}
+	if _, err := b.Subscribe(1, Block); !errors.Is(err, ErrBroadcasterClosed) {
+		t.Fatalf("Subscribe after the input closed: %v", err)
+	}
+}
+
+func TestTee(t *testing.T) {
+	p := New(context.Background(), WithBuffer(1))
+	outs := Tee(p, "tee", FromSlice(p, 1, 2, 3), 2)
+	var mu sync.Mutex
+	sums := map[string]int{}
+	for i, out := range outs {
+		name := "sink" + strconv.Itoa(i)
+		Sink(p, name, out, func(ctx context.Context, n int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sums[name] += n
+			return nil
+		})
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if sums["sink0"] != 6 || sums["sink1"] != 6 {
+		t.Fatalf("sums %v", sums)
+	}
+
+	p = New(context.Background())
+	var se *StageError
+	if outs := Tee(p, "tee", FromSlice(p, 1, 2, 3), -1); outs != nil {
+		t.Fatalf("%d outputs for n = -1", len(outs))
+	}
+	if err := p.Wait(); !errors.As(err, &se) || se.Stage != "tee" {
+		t.Fatalf("Tee with n = -1: %v", err)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	collect := func(opts BatcherOptions[string], items ...string) ([][]string, BatcherStats) {
+		in := make(chan string)
+		var mu sync.Mutex
+		var batches [][]string
+		b := NewBatcher(context.Background(), in, func(ctx context.Context, batch []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, batch)
+			return nil
+		}, opts)
+		for _, item := range items {
+			in <- item
+		}
+		close(in)
+		if err := b.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		return batches, b.Stats()
+	}
+
+	got, stats := collect(BatcherOptions[string]{MaxItems: 3}, "1", "2", "3", "4", "5", "6", "7")
+	if len(got) != 3 || len(got[2]) != 1 || stats.Full != 2 || stats.Final != 1 || stats.Items != 7 {
+		t.Fatalf("by count: %v %+v", got, stats)
+	}
+
+	size := func(s string) int { return len(s) }
+	got, stats = collect(BatcherOptions[string]{MaxBytes: 10, Size: size}, "aaaa", "bbbb", "cccc", "dddddddddddd")
+	if !slices.Equal(got[0], []string{"aaaa", "bbbb"}) || len(got) != 3 || stats.Bytes != 3 {
+		t.Fatalf("by bytes: %v %+v", got, stats)
+	}
+
+	// Time: a lone item is written after MaxWait
+	in := make(chan int)
+	written := make(chan []int, 1)
+	b := NewBatcher(context.Background(), in, func(ctx context.Context, batch []int) error {
+		written <- batch
+		return nil
+	}, BatcherOptions[int]{MaxItems: 10, MaxWait: 20 * time.Millisecond})
+	in <- 1
+	select {
+	case batch := <-written:
+		if !slices.Equal(batch, []int{1}) {
+			t.Fatalf("timed out batch %v", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial batch not flushed after MaxWait")
+	}
+	close(in)
+	b.Wait()
+	if s := b.Stats(); s.Timeout != 1 || s.Final != 0 {
+		t.Fatalf("by time: %+v", s)
+	}
+}
+
+func TestBatcherBackpressureAndCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan int)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var batches [][]int
+	b := NewBatcher(ctx, in, func(ctx context.Context, batch []int) error {
+		<-release
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, batch)
+		return nil
+	}, BatcherOptions[int]{MaxItems: 2, MaxInFlight: 1})
+
+	in <- 1
+	in <- 2 // first batch now being written
+	in <- 3
+	in <- 4 // second batch waits for the write slot
+	select {
+	case in <- 5:
+		t.Fatal("batcher kept reading with every write slot taken")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	in <- 5
+	cancel() // the partial batch is still written
+	if err := b.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 || !slices.Equal(batches[2], []int{5}) {
+		t.Fatalf("batches %v", batches)
+	}
+}
@@ -0,0 +1,230 @@
+package spec
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"pipeline"
+)
+
+// Kind is what a stage does with the items flowing through it
+type Kind int
+
+const (
+	SourceKind Kind = iota
+	MapKind
+	FilterKind
+	FlatMapKind
+	BatchKind
+	SinkKind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case SourceKind:
+		return "source"
+	case MapKind:
+		return "map"
+	case FilterKind:
+		return "filter"
+	case FlatMapKind:
+		return "flatmap"
+	case BatchKind:
+		return "batch"
+	case SinkKind:
+		return "sink"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Stage is a built stage, ready to be wired into a pipeline. Items are
+// untyped since the document decides which stages follow each other.
+type Stage struct {
+	Kind Kind
+
+	source  func(ctx context.Context, emit func(any) error) error
+	mapFn   func(ctx context.Context, item any) (any, error)
+	filter  func(item any) bool
+	flatMap func(ctx context.Context, item any) ([]any, error)
+	sink    func(ctx context.Context, item any) error
+
+	batchSize int
+	batchWait time.Duration
+}
+
+// Source makes a stage that produces items
+func Source(fn func(ctx context.Context, emit func(any) error) error) Stage {
+	return Stage{Kind: SourceKind, source: fn}
+}
+
+// Map makes a stage that turns every item into another one
+func Map(fn func(ctx context.Context, item any) (any, error)) Stage {
+	return Stage{Kind: MapKind, mapFn: fn}
+}
+
+// Filter makes a stage that keeps the items keep returns true for
+func Filter(keep func(item any) bool) Stage {
+	return Stage{Kind: FilterKind, filter: keep}
+}
+
+// FlatMap makes a stage that turns every item into zero or more items
+func FlatMap(fn func(ctx context.Context, item any) ([]any, error)) Stage {
+	return Stage{Kind: FlatMapKind, flatMap: fn}
+}
+
+// Sink makes a stage that consumes items
+func Sink(fn func(ctx context.Context, item any) error) Stage {
+	return Stage{Kind: SinkKind, sink: fn}
+}
+
+// Builder builds a stage from the params given in a document
+type Builder func(params Params) (Stage, error)
+
+// Registry maps the stage types a document may use to their builders
+type Registry struct {
+	mu         sync.RWMutex
+	stages     map[string]Builder
+	errorSinks map[string]func(*pipeline.ItemError)
+}
+
+// NewRegistry returns a registry holding the built-in "batch" stage, which
+// takes the params size and max_wait
+func NewRegistry() *Registry {
+	r := &Registry{
+		stages:     make(map[string]Builder),
+		errorSinks: make(map[string]func(*pipeline.ItemError)),
+	}
+	r.Register("batch", func(params Params) (Stage, error) {
+		size, err := params.Int("size", 10)
+		if err != nil {
+			return Stage{}, err
+		}
+		wait, err := params.Duration("max_wait", 0)
+		if err != nil {
+			return Stage{}, err
+		}
+		if size < 1 {
+			return Stage{}, fmt.Errorf("size must be at least 1, got %d", size)
+		}
+		return Stage{Kind: BatchKind, batchSize: size, batchWait: wait}, nil
+	})
+	return r
+}
+
+// Register adds or replaces a stage type
+func (r *Registry) Register(typ string, b Builder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stages[typ] = b
+}
+
+// RegisterErrorSink names a function that documents can route failed
+// items to with the "route" error policy
+func (r *Registry) RegisterErrorSink(name string, sink func(*pipeline.ItemError)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errorSinks[name] = sink
+}
+
+// Types returns the registered stage types, sorted
+func (r *Registry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.stages))
+	for typ := range r.stages {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (r *Registry) builder(typ string) (Builder, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, ok := r.stages[typ]
+	return b, ok
+}
+
+func (r *Registry) errorSink(name string) (func(*pipeline.ItemError), bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.errorSinks[name]
+	return s, ok
+}
+
+// Params are the free-form parameters of one stage
+type Params map[string]any
+
+// Int returns params[name], or def if it is not set
+func (p Params) Int(name string, def int) (int, error) {
+	v, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64: // JSON numbers
+		if n == float64(int(n)) {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("param %s: expected an integer, got %v", name, v)
+}
+
+// Float returns params[name], or def if it is not set
+func (p Params) Float(name string, def float64) (float64, error) {
+	v, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	}
+	return 0, fmt.Errorf("param %s: expected a number, got %v", name, v)
+}
+
+// String returns params[name], or def if it is not set
+func (p Params) String(name string, def string) (string, error) {
+	v, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("param %s: expected a string, got %v", name, v)
+	}
+	return s, nil
+}
+
+// Bool returns params[name], or def if it is not set
+func (p Params) Bool(name string, def bool) (bool, error) {
+	v, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("param %s: expected true or false, got %v", name, v)
+	}
+	return b, nil
+}
+
+// Duration returns params[name] parsed like "250ms", or def if it is not set
+func (p Params) Duration(name string, def time.Duration) (time.Duration, error) {
+	s, err := p.String(name, "")
+	if err != nil || s == "" {
+		return def, err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("param %s: %v", name, err)
+	}
+	return d, nil
+}
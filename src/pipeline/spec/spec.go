@@ -0,0 +1,351 @@
+// Package spec builds pipelines from YAML or JSON documents, so the order
+// and settings of stages can change without a rebuild:
+//
+//	name: numbers
+//	buffer: 4
+//	errors:
+//	  policy: skip
+//	  retry: {max_attempts: 3, base_delay: 10ms}
+//	stages:
+//	  - {name: generate, type: range, params: {from: 1, to: 10}}
+//	  - {name: double, type: multiply, params: {by: 2}, concurrency: 3}
+//	  - {name: batch, type: batch, params: {size: 4, max_wait: 100ms}}
+//	  - {name: print, type: print, errors: {policy: route, sink: stderr}}
+//
+// Stage types and error sinks are looked up in a Registry. The first stage
+// must be a source, the last one a sink, and everything in between
+// transforms items. Stage names must not contain "/", which is reserved
+// for stages the package adds, such as the "<name>/items" stage that
+// hands on the batches of a batch stage.
+package spec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"pipeline"
+	"workerpool"
+)
+
+// ErrInvalid wraps every problem Validate finds in a document
+var ErrInvalid = errors.New("spec: invalid pipeline")
+
+// Document is a declarative pipeline
+type Document struct {
+	Name   string       `yaml:"name" json:"name"`
+	Buffer int          `yaml:"buffer" json:"buffer"` // default channel buffer between stages
+	Errors *ErrorPolicy `yaml:"errors" json:"errors"` // default error policy
+	Stages []StageSpec  `yaml:"stages" json:"stages"`
+}
+
+// StageSpec is one stage of a document
+type StageSpec struct {
+	Name   string `yaml:"name" json:"name"`
+	Type   string `yaml:"type" json:"type"`
+	Params Params `yaml:"params" json:"params"`
+
+	// Concurrency runs a map stage on this many goroutines, keeping input
+	// order with a reorder buffer of ReorderLimit items
+	Concurrency  int `yaml:"concurrency" json:"concurrency"`
+	ReorderLimit int `yaml:"reorder_limit" json:"reorder_limit"`
+
+	Buffer *int         `yaml:"buffer" json:"buffer"`
+	Errors *ErrorPolicy `yaml:"errors" json:"errors"`
+}
+
+// ErrorPolicy is the document form of a pipeline.ErrorStrategy
+type ErrorPolicy struct {
+	Policy string     `yaml:"policy" json:"policy"` // fail-fast (default), skip or route
+	Sink   string     `yaml:"sink" json:"sink"`     // registered error sink for route
+	Retry  *RetrySpec `yaml:"retry" json:"retry"`
+}
+
+// RetrySpec is the document form of a workerpool.RetryPolicy
+type RetrySpec struct {
+	MaxAttempts int      `yaml:"max_attempts" json:"max_attempts"`
+	BaseDelay   Duration `yaml:"base_delay" json:"base_delay"`
+	MaxDelay    Duration `yaml:"max_delay" json:"max_delay"`
+	Multiplier  float64  `yaml:"multiplier" json:"multiplier"`
+	Jitter      float64  `yaml:"jitter" json:"jitter"`
+}
+
+// Duration is a time.Duration written like "250ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Load reads a document; files ending in .json are JSON, anything else YAML
+func Load(path string) (*Document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return ParseJSON(data)
+	}
+	return ParseYAML(data)
+}
+
+// ParseYAML decodes a YAML document, rejecting unknown fields
+func ParseYAML(data []byte) (*Document, error) {
+	var doc Document
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("spec: %w", err)
+	}
+	return &doc, nil
+}
+
+// ParseJSON decodes a JSON document, rejecting unknown fields
+func ParseJSON(data []byte) (*Document, error) {
+	var doc Document
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("spec: %w", err)
+	}
+	return &doc, nil
+}
+
+// built is a validated stage
+type built struct {
+	spec     StageSpec
+	stage    Stage
+	strategy *pipeline.ErrorStrategy
+}
+
+// Validate checks the document against reg and builds every stage, so
+// bad params are caught before anything runs. All problems are reported
+// at once.
+func (d *Document) Validate(reg *Registry) error {
+	_, _, err := d.build(reg)
+	return err
+}
+
+func (d *Document) build(reg *Registry) ([]built, *pipeline.ErrorStrategy, error) {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	def, err := d.Errors.strategy(reg)
+	if err != nil {
+		problem("errors: %v", err)
+	}
+	if d.Buffer < 0 {
+		problem("buffer must not be negative")
+	}
+	if len(d.Stages) < 2 {
+		problem("a pipeline needs at least a source and a sink")
+	}
+
+	var stages []built
+	seen := map[string]bool{}
+	for i, s := range d.Stages {
+		where := fmt.Sprintf("stage %d (%s)", i+1, s.Name)
+		if s.Name == "" {
+			problem("stage %d: missing name", i+1)
+		} else if seen[s.Name] {
+			problem("%s: name used twice", where)
+		} else if strings.Contains(s.Name, "/") {
+			problem(`%s: "/" is reserved for added stages`, where)
+		}
+		seen[s.Name] = true
+
+		b, ok := reg.builder(s.Type)
+		if !ok {
+			problem("%s: unknown type %q (known: %s)", where, s.Type, strings.Join(reg.Types(), ", "))
+			continue
+		}
+		stage, err := b(s.Params)
+		if err != nil {
+			problem("%s: %v", where, err)
+			continue
+		}
+
+		switch {
+		case i == 0 && stage.Kind != SourceKind:
+			problem("%s: the first stage must be a source, %s is a %s", where, s.Type, stage.Kind)
+		case i == len(d.Stages)-1 && stage.Kind != SinkKind:
+			problem("%s: the last stage must be a sink, %s is a %s", where, s.Type, stage.Kind)
+		case i > 0 && i < len(d.Stages)-1 && (stage.Kind == SourceKind || stage.Kind == SinkKind):
+			problem("%s: a %s can only come first or last", where, stage.Kind)
+		}
+		if s.Concurrency < 0 || s.ReorderLimit < 0 {
+			problem("%s: concurrency and reorder_limit must not be negative", where)
+		}
+		if s.Concurrency > 1 && stage.Kind != MapKind {
+			problem("%s: concurrency only applies to map stages", where)
+		}
+		if s.Buffer != nil && *s.Buffer < 0 {
+			problem("%s: buffer must not be negative", where)
+		}
+		strategy, err := s.Errors.strategy(reg)
+		if err != nil {
+			problem("%s: errors: %v", where, err)
+		}
+		stages = append(stages, built{spec: s, stage: stage, strategy: strategy})
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalid, errors.Join(errs...))
+	}
+	return stages, def, nil
+}
+
+// strategy converts the policy; nil means the pipeline default
+func (e *ErrorPolicy) strategy(reg *Registry) (*pipeline.ErrorStrategy, error) {
+	if e == nil {
+		return nil, nil
+	}
+
+	var s pipeline.ErrorStrategy
+	switch e.Policy {
+	case "", "fail-fast":
+		s = pipeline.FailFast()
+	case "skip":
+		s = pipeline.SkipAndCollect()
+	case "route":
+		sink, ok := reg.errorSink(e.Sink)
+		if !ok {
+			return nil, fmt.Errorf("unknown error sink %q", e.Sink)
+		}
+		s = pipeline.RouteErrors(sink)
+	default:
+		return nil, fmt.Errorf("unknown policy %q (want fail-fast, skip or route)", e.Policy)
+	}
+
+	if r := e.Retry; r != nil {
+		if r.MaxAttempts < 1 {
+			return nil, fmt.Errorf("retry.max_attempts must be at least 1")
+		}
+		s = pipeline.Retry(workerpool.RetryPolicy{
+			MaxAttempts: r.MaxAttempts,
+			BaseDelay:   time.Duration(r.BaseDelay),
+			MaxDelay:    time.Duration(r.MaxDelay),
+			Multiplier:  r.Multiplier,
+			Jitter:      r.Jitter,
+		}, s)
+	}
+	return &s, nil
+}
+
+func (e *ErrorPolicy) String() string {
+	if e == nil {
+		return "default"
+	}
+	s := e.Policy
+	if s == "" {
+		s = "fail-fast"
+	}
+	if e.Policy == "route" {
+		s += " to " + e.Sink
+	}
+	if e.Retry != nil {
+		s = fmt.Sprintf("retry x%d, then %s", e.Retry.MaxAttempts, s)
+	}
+	return s
+}
+
+// PrintPlan validates the document and describes what Run would build
+func (d *Document) PrintPlan(w io.Writer, reg *Registry) error {
+	stages, _, err := d.build(reg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Pipeline %q: %d stages, buffer %d, errors: %v\n", d.Name, len(stages), d.Buffer, d.Errors)
+	for i, b := range stages {
+		s := b.spec
+		line := fmt.Sprintf("%2d. %-12s %-8s type=%s", i+1, s.Name, b.stage.Kind, s.Type)
+		if s.Concurrency > 1 {
+			line += fmt.Sprintf(" concurrency=%d reorder_limit=%d", s.Concurrency, s.ReorderLimit)
+		}
+		if s.Buffer != nil {
+			line += fmt.Sprintf(" buffer=%d", *s.Buffer)
+		}
+		if s.Errors != nil {
+			line += fmt.Sprintf(" errors=%v", s.Errors)
+		}
+		if len(s.Params) > 0 {
+			line += fmt.Sprintf(" params=%v", map[string]any(s.Params))
+		}
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// Run builds the pipeline and runs it to completion. opts are applied
+// before the document's own settings.
+func (d *Document) Run(ctx context.Context, reg *Registry, opts ...pipeline.Option) error {
+	stages, def, err := d.build(reg)
+	if err != nil {
+		return err
+	}
+
+	opts = append(opts, pipeline.WithBuffer(d.Buffer))
+	if def != nil {
+		opts = append(opts, pipeline.WithErrorStrategy(*def))
+	}
+	for _, b := range stages {
+		// A batch stage runs as two pipeline stages; both get its settings
+		names := []string{b.spec.Name}
+		if b.stage.Kind == BatchKind {
+			names = append(names, b.spec.Name+"/items")
+		}
+		for _, name := range names {
+			if b.spec.Buffer != nil {
+				opts = append(opts, pipeline.WithStageBuffer(name, *b.spec.Buffer))
+			}
+			if b.strategy != nil {
+				opts = append(opts, pipeline.WithStageErrorStrategy(name, *b.strategy))
+			}
+		}
+	}
+	p := pipeline.New(ctx, opts...)
+
+	var items <-chan any
+	for _, b := range stages {
+		name, st := b.spec.Name, b.stage
+		switch st.Kind {
+		case SourceKind:
+			items = pipeline.Source(p, name, st.source)
+		case MapKind:
+			if b.spec.Concurrency > 1 {
+				items = pipeline.ParallelMap(p, name, items, b.spec.Concurrency, b.spec.ReorderLimit, st.mapFn)
+			} else {
+				items = pipeline.Map(p, name, items, st.mapFn)
+			}
+		case FilterKind:
+			items = pipeline.Filter(p, name, items, st.filter)
+		case FlatMapKind:
+			items = pipeline.FlatMap(p, name, items, st.flatMap)
+		case BatchKind:
+			batches := pipeline.Batch(p, name, items, st.batchSize, st.batchWait)
+			items = pipeline.Map(p, name+"/items", batches, func(ctx context.Context, b []any) (any, error) {
+				return b, nil
+			})
+		case SinkKind:
+			pipeline.Sink(p, name, items, st.sink)
+		}
+	}
+	return p.Wait()
+}
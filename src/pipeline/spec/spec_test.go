@@ -0,0 +1,114 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"pipeline"
+)
+
+func testRegistry(out *[]string, mu *sync.Mutex) *Registry {
+	reg := NewRegistry()
+	reg.Register("range", func(params Params) (Stage, error) {
+		to, err := params.Int("to", 5)
+		return Source(func(ctx context.Context, emit func(any) error) error {
+			for i := 1; i <= to; i++ {
+				if err := emit(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}), err
+	})
+	reg.Register("multiply", func(params Params) (Stage, error) {
+		by, err := params.Int("by", 2)
+		return Map(func(ctx context.Context, item any) (any, error) {
+			if item.(int) == 3 {
+				return nil, errors.New("three")
+			}
+			return item.(int) * by, nil
+		}), err
+	})
+	reg.Register("collect", func(params Params) (Stage, error) {
+		return Sink(func(ctx context.Context, item any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			*out = append(*out, fmt.Sprint(item))
+			return nil
+		}), nil
+	})
+	reg.RegisterErrorSink("ignore", func(*pipeline.ItemError) {})
+	return reg
+}
+
+func TestRunYAMLAndJSON(t *testing.T) {
+	yamlDoc := `
+name: numbers
+buffer: 2
+errors: {policy: route, sink: ignore}
+stages:
+  - {name: gen, type: range, params: {to: 7}}
+  - {name: triple, type: multiply, params: {by: 3}, concurrency: 3, reorder_limit: 2}
+  - {name: batch, type: batch, params: {size: 3}}
+  - {name: out, type: collect, buffer: 0}
+`
+	jsonDoc := `{"name": "numbers", "errors": {"policy": "skip"}, "stages": [
+		{"name": "gen", "type": "range", "params": {"to": 7}},
+		{"name": "triple", "type": "multiply", "params": {"by": 3}},
+		{"name": "batch", "type": "batch", "params": {"size": 3}},
+		{"name": "out", "type": "collect"}]}`
+
+	for format, parse := range map[string]func([]byte) (*Document, error){"yaml": ParseYAML, "json": ParseJSON} {
+		data := yamlDoc
+		if format == "json" {
+			data = jsonDoc
+		}
+		doc, err := parse([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		var out []string
+		var mu sync.Mutex
+		err = doc.Run(context.Background(), testRegistry(&out, &mu))
+		var report *pipeline.ErrorReport
+		if !errors.As(err, &report) || len(report.Items) != 1 {
+			t.Errorf("%s: got %v; expected one skipped item", format, err)
+		}
+		if want := []string{"[3 6 12]", "[15 18 21]"}; !slices.Equal(out, want) {
+			t.Errorf("%s: got %v; expected %v", format, out, want)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	doc, err := ParseYAML([]byte(`
+errors: {policy: shrug}
+stages:
+  - {name: first, type: multiply}
+  - {name: first, type: nope}
+  - {name: batch/items, type: multiply}
+  - {name: last, type: batch, params: {size: 0}, concurrency: 2}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Validate(testRegistry(nil, nil))
+	if !errors.Is(err, ErrInvalid) {
+		t.Fatalf("got %v; expected ErrInvalid", err)
+	}
+	for _, want := range []string{`unknown policy "shrug"`, "first stage must be a source", "name used twice", `"/" is reserved`, `unknown type "nope"`, "size must be at least 1"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q missing from:\n%v", want, err)
+		}
+	}
+
+	if _, err := ParseYAML([]byte("stages: []\nworkers: 3\n")); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
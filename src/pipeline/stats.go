@@ -0,0 +1,241 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+)
+
+// StageStats is what one stage did so far
+type StageStats struct {
+	Name     string
+	Workers  int
+	In       int64 // items received
+	Out      int64 // items sent downstream
+	Elapsed  time.Duration
+	Busy     time.Duration // running the stage function, summed over workers
+	SendWait time.Duration // blocked sending to a full downstream channel
+	RecvWait time.Duration // blocked waiting for the next input item
+	// Other is the rest of the workers' time: between items and in the
+	// stage's own bookkeeping
+	Other time.Duration
+
+	// Utilisation is Busy over Elapsed times Workers
+	Utilisation float64
+
+	// Buffer is the capacity of the output channel and Occupancy how full
+	// it was on average when the stage sent an item, from 0 to 1
+	Buffer    int
+	Occupancy float64
+}
+
+// PerItem returns the average time the stage spent on one item
+func (s StageStats) PerItem() time.Duration {
+	n := max(s.In, s.Out) // sources only send
+	if n == 0 {
+		return 0
+	}
+	return s.Busy / time.Duration(n)
+}
+
+// stageMeter measures a running stage: its metrics plus what Stats
+// reports
+type stageMeter struct {
+	*metrics.Stage
+	name string
+
+	workers  atomic.Int64
+	started  atomic.Int64 // Unix nanoseconds
+	stopped  atomic.Int64
+	in, out  atomic.Int64
+	busy     atomic.Int64 // nanoseconds
+	sendWait atomic.Int64
+	recvWait atomic.Int64
+	capacity atomic.Int64
+	queued   atomic.Int64 // sum of the output channel length at every send
+}
+
+func (m *stageMeter) received() {
+	m.In.Inc()
+	m.in.Add(1)
+}
+
+// waited records that the stage blocked for input since start
+func (m *stageMeter) waited(start time.Time) {
+	m.recvWait.Add(int64(time.Since(start)))
+}
+
+// receive ranges over in like a for loop and records how long each
+// receive blocked
+func receive[T any](in <-chan T, m *stageMeter) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for {
+			var item T
+			var ok bool
+			select {
+			case item, ok = <-in:
+			default:
+				start := time.Now()
+				item, ok = <-in
+				m.waited(start)
+			}
+			if !ok || !yield(item) {
+				return
+			}
+		}
+	}
+}
+
+// sending records the state of the output channel just before a send
+func (m *stageMeter) sending(queued, capacity int) {
+	m.capacity.Store(int64(capacity))
+	m.queued.Add(int64(queued))
+}
+
+func (m *stageMeter) sent(wait time.Duration) {
+	m.Out.Inc()
+	m.out.Add(1)
+	m.sendWait.Add(int64(wait))
+}
+
+// Observe records one item processed since start
+func (m *stageMeter) Observe(start time.Time) {
+	m.Stage.Observe(start)
+	m.busy.Add(int64(time.Since(start)))
+}
+
+func (m *stageMeter) stats(now time.Time) StageStats {
+	s := StageStats{
+		Name:     m.name,
+		Workers:  int(max(m.workers.Load(), 1)),
+		In:       m.in.Load(),
+		Out:      m.out.Load(),
+		Busy:     time.Duration(m.busy.Load()),
+		SendWait: time.Duration(m.sendWait.Load()),
+		RecvWait: time.Duration(m.recvWait.Load()),
+		Buffer:   int(m.capacity.Load()),
+	}
+	if started := m.started.Load(); started > 0 {
+		end := now.UnixNano()
+		if stopped := m.stopped.Load(); stopped > 0 {
+			end = stopped
+		}
+		s.Elapsed = time.Duration(end - started)
+	}
+	total := s.Elapsed * time.Duration(s.Workers)
+	s.Other = max(total-s.Busy-s.SendWait-s.RecvWait, 0)
+	if total > 0 {
+		s.Utilisation = float64(s.Busy) / float64(total)
+	}
+	if s.Buffer > 0 && s.Out > 0 {
+		s.Occupancy = float64(m.queued.Load()) / float64(s.Out) / float64(s.Buffer)
+	}
+	return s
+}
+
+// Stats returns the statistics of every stage, in the order the stages
+// were added. It can be called while the pipeline runs.
+func (p *Pipeline) Stats() []StageStats {
+	p.mu.Lock()
+	stages := append([]*stageMeter(nil), p.stages...)
+	p.mu.Unlock()
+
+	now := time.Now()
+	out := make([]StageStats, len(stages))
+	for i, m := range stages {
+		out[i] = m.stats(now)
+	}
+	return out
+}
+
+// StatsReport names the stage that limits a pipeline's throughput
+type StatsReport struct {
+	Stages []StageStats
+
+	// Bottleneck is the stage with the lowest capacity, or "" if nothing has run yet
+	Bottleneck string
+	// Suggested is how many workers the bottleneck needs to keep up with
+	// the next slowest stage; 0 when adding workers would not help
+	Suggested int
+}
+
+// AnalyzeStats finds the bottleneck among stats. A stage's capacity is
+// how many items per second its workers could handle if they never
+// waited; the stage with the lowest capacity holds the others back.
+func AnalyzeStats(stats []StageStats) StatsReport {
+	r := StatsReport{Stages: stats}
+
+	capacity := func(s StageStats) float64 {
+		if s.PerItem() <= 0 {
+			return math.Inf(1)
+		}
+		return float64(s.Workers) / s.PerItem().Seconds()
+	}
+	slowest, next := -1, math.Inf(1)
+	for i, s := range stats {
+		c := capacity(s)
+		switch {
+		case math.IsInf(c, 1):
+		case slowest < 0 || c < capacity(stats[slowest]):
+			if slowest >= 0 {
+				next = capacity(stats[slowest])
+			}
+			slowest = i
+		case c < next:
+			next = c
+		}
+	}
+	if slowest < 0 {
+		return r
+	}
+
+	b := stats[slowest]
+	r.Bottleneck = b.Name
+	// A source has no input to spread over more workers
+	if b.In > 0 && !math.IsInf(next, 1) {
+		r.Suggested = int(math.Ceil(next * b.PerItem().Seconds()))
+		if r.Suggested <= b.Workers {
+			r.Suggested = 0
+		}
+	}
+	return r
+}
+
+// Print writes the statistics as a table followed by the diagnosis
+func (r StatsReport) Print(w io.Writer) {
+	ms := func(d time.Duration) string { return d.Round(time.Millisecond).String() }
+	fmt.Fprintf(w, "%-12s %7s %6s %6s %9s %10s %10s %10s %6s %7s\n",
+		"Stage", "Workers", "In", "Out", "Per item", "Busy", "Send wait", "Recv wait", "Util", "Queue")
+	for _, s := range r.Stages {
+		queue := "-"
+		if s.Buffer > 0 {
+			queue = fmt.Sprintf("%.0f%%", s.Occupancy*100)
+		}
+		fmt.Fprintf(w, "%-12s %7d %6d %6d %9s %10s %10s %10s %5.1f%% %7s\n",
+			s.Name, s.Workers, s.In, s.Out, ms(s.PerItem()), ms(s.Busy), ms(s.SendWait), ms(s.RecvWait), s.Utilisation*100, queue)
+	}
+
+	if r.Bottleneck == "" {
+		fmt.Fprintln(w, "\nNo items processed yet")
+		return
+	}
+	for _, s := range r.Stages {
+		if s.Name != r.Bottleneck {
+			continue
+		}
+		fmt.Fprintf(w, "\nBottleneck: %s (%.0f%% busy, %s per item)\n", s.Name, s.Utilisation*100, ms(s.PerItem()))
+		switch {
+		case s.In == 0:
+			fmt.Fprintln(w, "The source produces items slower than the stages after it can take them")
+		case r.Suggested > 0:
+			fmt.Fprintf(w, "Run it with %d workers (now %d) to keep up with the next slowest stage\n", r.Suggested, s.Workers)
+		default:
+			fmt.Fprintln(w, "It already keeps up with the other stages")
+		}
+	}
+}
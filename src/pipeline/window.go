@@ -0,0 +1,480 @@
+package pipeline
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+type windowKind int
+
+const (
+	tumbling windowKind = iota
+	sliding
+	session
+	countBased
+)
+
+// ErrBadWindow is reported by a Window stage whose window durations are
+// not positive
+var ErrBadWindow = errors.New("pipeline: window durations must be positive")
+
+// Windowing says how a Window stage groups items
+type Windowing struct {
+	kind  windowKind
+	size  time.Duration
+	slide time.Duration
+	gap   time.Duration
+	count int
+	every int
+	err   error // reported by the Window stage
+}
+
+// Tumbling groups items into back-to-back windows of length size
+func Tumbling(size time.Duration) Windowing {
+	return Windowing{kind: tumbling, size: size, slide: size,
+		err: positive("tumbling window size", size)}
+}
+
+// Sliding groups items into windows of length size starting every slide,
+// so an item can belong to several windows. With slide longer than size
+// items falling between windows are dropped.
+func Sliding(size, slide time.Duration) Windowing {
+	return Windowing{kind: sliding, size: size, slide: slide,
+		err: errors.Join(positive("sliding window size", size), positive("sliding window slide", slide))}
+}
+
+// Session groups items separated by less than gap; a window closes after
+// gap passes without items
+func Session(gap time.Duration) Windowing {
+	return Windowing{kind: session, gap: gap, err: positive("session gap", gap)}
+}
+
+func positive(what string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%w: %s is %v", ErrBadWindow, what, d)
+	}
+	return nil
+}
+
+// TumblingCount emits a window every n items
+func TumblingCount(n int) Windowing {
+	return SlidingCount(n, n)
+}
+
+// SlidingCount emits the last n items every time every more items arrive
+func SlidingCount(n, every int) Windowing {
+	return Windowing{kind: countBased, count: max(n, 1), every: max(every, 1)}
+}
+
+// tick is how often a processing-time window stage checks the clock
+func (w Windowing) tick() time.Duration {
+	d := w.slide
+	if w.kind == session {
+		d = w.gap
+	}
+	return max(d/4, time.Millisecond)
+}
+
+// Pane is the content of one window
+type Pane[T any] struct {
+	Key   string
+	Start time.Time
+	End   time.Time // exclusive; for count windows the time of the last item
+	Items []T
+}
+
+// Summary aggregates the values of a pane
+func (w Pane[T]) Summary(value func(T) float64) Summary {
+	values := make([]float64, len(w.Items))
+	for i, item := range w.Items {
+		values[i] = value(item)
+	}
+	return Summarize(values)
+}
+
+// WindowOption configures a Window stage
+type WindowOption[T any] func(*windowConfig[T])
+
+type windowConfig[T any] struct {
+	eventTime func(T) time.Time
+	key       func(T) string
+	lateness  time.Duration
+	onLate    func(T)
+}
+
+// WithEventTime windows items by the time they carry instead of the time
+// they arrive. The watermark then follows the newest event time seen.
+func WithEventTime[T any](eventTime func(T) time.Time) WindowOption[T] {
+	return func(c *windowConfig[T]) { c.eventTime = eventTime }
+}
+
+// WithKey keeps separate windows per key
+func WithKey[T any](key func(T) string) WindowOption[T] {
+	return func(c *windowConfig[T]) { c.key = key }
+}
+
+// WithAllowedLateness holds windows open for d after their end, so items
+// up to d out of order still land in the right window
+func WithAllowedLateness[T any](d time.Duration) WindowOption[T] {
+	return func(c *windowConfig[T]) { c.lateness = d }
+}
+
+// WithLateItems is called with every item that arrives after all of its
+// windows have been emitted. Late items are dropped otherwise.
+func WithLateItems[T any](fn func(T)) WindowOption[T] {
+	return func(c *windowConfig[T]) { c.onLate = fn }
+}
+
+// Window groups items into panes. A time window is emitted once the
+// watermark (newest time seen minus the allowed lateness) passes its end;
+// whatever is still open is emitted when the input closes. A window with
+// a non-positive duration fails the stage with ErrBadWindow.
+func Window[T any](p *Pipeline, name string, in <-chan T, w Windowing, opts ...WindowOption[T]) <-chan Pane[T] {
+	cfg := windowConfig[T]{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	out := make(chan Pane[T], p.buffer(name))
+	ws := &windows[T]{w: w, panes: make(map[paneID]*Pane[T]), recent: make(map[string]*countPane[T])}
+	mu := p.stateful(name, ws)
+
+	p.spawn(name, func(ctx context.Context, m *stageMeter) error {
+		defer close(out)
+		if w.err != nil {
+			return w.err
+		}
+
+		// emit is called with mu held
+		emit := func(panes []*Pane[T]) bool {
+			for _, pane := range panes {
+				if !send(ctx, p, out, *pane, m) {
+					return false
+				}
+			}
+			return true
+		}
+		advance := func(wm time.Time) bool {
+			if wm.After(ws.watermark) {
+				ws.watermark = wm
+			}
+			return emit(ws.fire(ws.watermark, false))
+		}
+
+		// In processing time the clock moves the watermark even when no
+		// items arrive
+		var tick <-chan time.Time
+		if cfg.eventTime == nil && w.kind != countBased {
+			ticker := time.NewTicker(w.tick())
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			// Waiting for the clock is waiting for input too
+			start := time.Now()
+			select {
+			case item, ok := <-in:
+				m.waited(start)
+				mu.Lock()
+				if !ok {
+					emit(ws.flush())
+					mu.Unlock()
+					return nil
+				}
+				m.received()
+
+				at := time.Now()
+				if cfg.eventTime != nil {
+					at = cfg.eventTime(item)
+				}
+				key := ""
+				if cfg.key != nil {
+					key = cfg.key(item)
+				}
+
+				sent := true
+				if w.kind == countBased {
+					if pane := ws.addCount(key, at, item); pane != nil {
+						sent = emit([]*Pane[T]{pane})
+					}
+				} else {
+					if added, late := ws.add(key, at, item, ws.watermark); !added {
+						m.Dropped.Inc()
+						if late && cfg.onLate != nil {
+							cfg.onLate(item)
+						}
+					}
+					sent = advance(at.Add(-cfg.lateness))
+				}
+				p.done(1) // the item is part of the stage's state now
+				mu.Unlock()
+				if !sent {
+					return nil
+				}
+			case now := <-tick:
+				m.waited(start)
+				mu.Lock()
+				sent := advance(now.Add(-cfg.lateness))
+				mu.Unlock()
+				if !sent {
+					return nil
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	return out
+}
+
+type paneID struct {
+	key   string
+	start int64 // Unix nanoseconds, so restored times compare equal
+}
+
+type countPane[T any] struct {
+	items []T
+	times []time.Time
+	since int // items added since the last emit
+}
+
+// windows holds the open panes of a Window stage
+type windows[T any] struct {
+	w         Windowing
+	watermark time.Time
+	panes     map[paneID]*Pane[T]      // tumbling and sliding
+	sessions  map[string][]*Pane[T]    // session, by key
+	recent    map[string]*countPane[T] // count based, by key
+}
+
+// windowsState is how windows are checkpointed
+type windowsState[T any] struct {
+	Watermark time.Time                `json:"watermark"`
+	Panes     []*Pane[T]               `json:"panes,omitempty"`
+	Counts    map[string]countState[T] `json:"counts,omitempty"`
+}
+
+type countState[T any] struct {
+	Items []T         `json:"items"`
+	Times []time.Time `json:"times"`
+	Since int         `json:"since"`
+}
+
+func (ws *windows[T]) MarshalJSON() ([]byte, error) {
+	st := windowsState[T]{Watermark: ws.watermark, Counts: make(map[string]countState[T])}
+	for _, pane := range ws.panes {
+		st.Panes = append(st.Panes, pane)
+	}
+	for _, sessions := range ws.sessions {
+		st.Panes = append(st.Panes, sessions...)
+	}
+	sortPanes(st.Panes)
+	for key, c := range ws.recent {
+		st.Counts[key] = countState[T]{Items: c.items, Times: c.times, Since: c.since}
+	}
+	return json.Marshal(st)
+}
+
+func (ws *windows[T]) UnmarshalJSON(data []byte) error {
+	var st windowsState[T]
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	ws.watermark = st.Watermark
+	for _, pane := range st.Panes {
+		if ws.w.kind == session {
+			if ws.sessions == nil {
+				ws.sessions = make(map[string][]*Pane[T])
+			}
+			ws.sessions[pane.Key] = append(ws.sessions[pane.Key], pane)
+		} else {
+			ws.panes[paneID{pane.Key, pane.Start.UnixNano()}] = pane
+		}
+	}
+	for key, c := range st.Counts {
+		ws.recent[key] = &countPane[T]{items: c.Items, times: c.Times, since: c.Since}
+	}
+	return nil
+}
+
+// add puts item in every open window it belongs to. late reports that
+// it belongs to windows that were all emitted already.
+func (ws *windows[T]) add(key string, at time.Time, item T, watermark time.Time) (added, late bool) {
+	if ws.w.kind == session {
+		added = ws.addSession(key, at, item, watermark)
+		return added, !added
+	}
+
+	// An item between two sliding windows is in no window and not late
+	for start := at.Truncate(ws.w.slide); start.Add(ws.w.size).After(at); start = start.Add(-ws.w.slide) {
+		end := start.Add(ws.w.size)
+		if !end.After(watermark) {
+			// This window and every earlier one are gone
+			return added, !added
+		}
+		id := paneID{key, start.UnixNano()}
+		pane, ok := ws.panes[id]
+		if !ok {
+			pane = &Pane[T]{Key: key, Start: start, End: end}
+			ws.panes[id] = pane
+		}
+		pane.Items = append(pane.Items, item)
+		added = true
+	}
+	return added, false
+}
+
+// addSession merges item with every session of key it falls within gap of
+func (ws *windows[T]) addSession(key string, at time.Time, item T, watermark time.Time) bool {
+	end := at.Add(ws.w.gap)
+	if !end.After(watermark) {
+		return false
+	}
+	if ws.sessions == nil {
+		ws.sessions = make(map[string][]*Pane[T])
+	}
+
+	merged := &Pane[T]{Key: key, Start: at, End: end, Items: []T{item}}
+	var keep []*Pane[T]
+	for _, s := range ws.sessions[key] {
+		if s.Start.After(end) || !s.End.After(at) {
+			keep = append(keep, s)
+			continue
+		}
+		if s.Start.Before(merged.Start) {
+			merged.Start = s.Start
+		}
+		if s.End.After(merged.End) {
+			merged.End = s.End
+		}
+		merged.Items = append(s.Items, merged.Items...)
+	}
+	ws.sessions[key] = append(keep, merged)
+	return true
+}
+
+// addCount returns a pane when key has collected enough new items
+func (ws *windows[T]) addCount(key string, at time.Time, item T) *Pane[T] {
+	c, ok := ws.recent[key]
+	if !ok {
+		c = &countPane[T]{}
+		ws.recent[key] = c
+	}
+	c.items = append(c.items, item)
+	c.times = append(c.times, at)
+	if len(c.items) > ws.w.count {
+		c.items = c.items[1:]
+		c.times = c.times[1:]
+	}
+	c.since++
+	if c.since < ws.w.every {
+		return nil
+	}
+	c.since = 0
+	return c.pane(key)
+}
+
+func (c *countPane[T]) pane(key string) *Pane[T] {
+	return &Pane[T]{
+		Key:   key,
+		Start: c.times[0],
+		End:   c.times[len(c.times)-1],
+		Items: slices.Clone(c.items),
+	}
+}
+
+// fire removes and returns the windows that end at or before watermark,
+// or every window if all is set
+func (ws *windows[T]) fire(watermark time.Time, all bool) []*Pane[T] {
+	var done []*Pane[T]
+	for id, pane := range ws.panes {
+		if all || !pane.End.After(watermark) {
+			done = append(done, pane)
+			delete(ws.panes, id)
+		}
+	}
+	for key, sessions := range ws.sessions {
+		open := sessions[:0]
+		for _, s := range sessions {
+			if !all && s.End.After(watermark) {
+				open = append(open, s)
+			} else {
+				done = append(done, s)
+			}
+		}
+		ws.sessions[key] = open
+	}
+	return sortPanes(done)
+}
+
+// flush returns every window still open
+func (ws *windows[T]) flush() []*Pane[T] {
+	done := ws.fire(time.Time{}, true)
+	for key, c := range ws.recent {
+		// Tumbling count windows emit their partial last window;
+		// sliding ones only if something arrived since the last emit
+		if c.since > 0 {
+			done = append(done, c.pane(key))
+		}
+	}
+	return sortPanes(done)
+}
+
+func sortPanes[T any](panes []*Pane[T]) []*Pane[T] {
+	slices.SortFunc(panes, func(a, b *Pane[T]) int {
+		return cmp.Or(a.End.Compare(b.End), cmp.Compare(a.Key, b.Key), a.Start.Compare(b.Start))
+	})
+	return panes
+}
+
+// Summary holds the usual aggregates over a set of values
+type Summary struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+
+	sorted []float64
+}
+
+// Summarize aggregates values
+func Summarize(values []float64) Summary {
+	s := Summary{Count: len(values), sorted: slices.Clone(values)}
+	if len(values) == 0 {
+		return s
+	}
+	slices.Sort(s.sorted)
+	s.Min, s.Max = s.sorted[0], s.sorted[len(s.sorted)-1]
+	for _, v := range values {
+		s.Sum += v
+	}
+	return s
+}
+
+// Mean returns the average value, or 0 when there are none
+func (s Summary) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// Percentile returns the q-th percentile (0-100), interpolating between
+// the two nearest values
+func (s Summary) Percentile(q float64) float64 {
+	if len(s.sorted) == 0 {
+		return math.NaN()
+	}
+	rank := min(max(q, 0), 100) / 100 * float64(len(s.sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	frac := rank - float64(lo)
+	return s.sorted[lo] + (s.sorted[hi]-s.sorted[lo])*frac
+}
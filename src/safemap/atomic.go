@@ -0,0 +1,162 @@
+package safemap
+
+import "fmt"
+
+// call is one GetOrCompute computation that other callers can wait for
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+	stale bool // the key was written meanwhile; set under the shard lock
+}
+
+// Update replaces the value under key with what fn returns, all under one
+// lock. fn gets the current value and whether there is one; returning
+// false deletes the key. Update returns what fn returned.
+func (m *SafeMap[K, V]) Update(key K, fn func(old V, ok bool) (V, bool)) (V, bool) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	old, ok := s.data[key]
+	v, keep := fn(old, ok)
+	if keep {
+		m.store(s, key, v)
+	} else {
+		m.remove(s, key)
+	}
+	return v, keep
+}
+
+// CompareAndSwap stores new under key if the current value equals old.
+// Like sync.Map it panics if V values are not comparable.
+func (m *SafeMap[K, V]) CompareAndSwap(key K, old, new V) bool {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	cur, ok := s.data[key]
+	if !ok || any(cur) != any(old) {
+		return false
+	}
+	m.store(s, key, new)
+	return true
+}
+
+// LoadOrStore returns the value under key if there is one. Otherwise it
+// stores value and returns it. loaded reports which happened.
+func (m *SafeMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.data[key]; ok {
+		return cur, true
+	}
+	m.store(s, key, value)
+	return value, false
+}
+
+// GetOrCompute returns the value under key, computing and storing it with
+// fn if there is none. Concurrent callers for the same key share one call
+// of fn; if it fails nothing is stored and every waiting caller gets the
+// error.
+//
+// fn runs without the shard lock, so a slow fn does not hold up the other
+// keys of the shard and fn may use the map itself. The call stays
+// registered in the shard meanwhile, and any write to the key while fn
+// runs wins: after a Set the stored value is returned, after a Delete
+// fn's value is returned but not stored.
+func (m *SafeMap[K, V]) GetOrCompute(key K, fn func() (V, error)) (V, error) {
+	s := m.shard(key)
+	s.Lock()
+	if v, ok := s.data[key]; ok {
+		s.Unlock()
+		return v, nil
+	}
+	if c, ok := s.calls[key]; ok {
+		s.Unlock()
+		<-c.done
+		return c.value, c.err
+	}
+	c := &call[V]{done: make(chan struct{})}
+	s.calls[key] = c
+	s.Unlock()
+
+	defer close(c.done)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.err = fmt.Errorf("safemap: compute panicked: %v", r)
+			}
+		}()
+		c.value, c.err = fn()
+	}()
+
+	s.Lock()
+	defer s.Unlock()
+	delete(s.calls, key)
+	if c.err == nil {
+		if cur, ok := s.data[key]; ok {
+			c.value = cur
+		} else if !c.stale {
+			m.store(s, key, c.value)
+		}
+	}
+	return c.value, c.err
+}
+
+// Swap exchanges the values of two keys. If only one of them has a value,
+// it moves to the other key.
+func (m *SafeMap[K, V]) Swap(a, b K) {
+	unlock := m.lockPair(a, b)
+	defer unlock()
+	sa, sb := m.shard(a), m.shard(b)
+	va, okA := sa.data[a]
+	vb, okB := sb.data[b]
+	if okA {
+		m.store(sb, b, va)
+	} else {
+		m.remove(sb, b)
+	}
+	if okB {
+		m.store(sa, a, vb)
+	} else {
+		m.remove(sa, a)
+	}
+}
+
+// Transfer updates two keys together, e.g. to move an amount from one
+// account to another. fn gets both current values (zero if missing) and
+// returns the new ones; if it returns an error nothing changes.
+func (m *SafeMap[K, V]) Transfer(from, to K, fn func(from, to V) (V, V, error)) error {
+	if from == to {
+		return fmt.Errorf("safemap: transfer from %v to itself", from)
+	}
+	unlock := m.lockPair(from, to)
+	defer unlock()
+	sf, st := m.shard(from), m.shard(to)
+	newFrom, newTo, err := fn(sf.data[from], st.data[to])
+	if err != nil {
+		return err
+	}
+	m.store(sf, from, newFrom)
+	m.store(st, to, newTo)
+	return nil
+}
+
+// lockPair write-locks the shards of two keys, lower index first so two
+// callers locking the same pair cannot deadlock
+func (m *SafeMap[K, V]) lockPair(a, b K) (unlock func()) {
+	i, j := m.index(a), m.index(b)
+	if i == j {
+		m.shards[i].Lock()
+		return m.shards[i].Unlock
+	}
+	if i > j {
+		i, j = j, i
+	}
+	m.shards[i].Lock()
+	m.shards[j].Lock()
+	return func() {
+		m.shards[j].Unlock()
+		m.shards[i].Unlock()
+	}
+}
@@ -0,0 +1,171 @@
+// Package safemap is a concurrent map split into shards that are locked
+// independently.
+//
+// A map behind one lock makes every writer queue on that lock. SafeMap
+// hashes each key to one of its shards, so goroutines working on
+// different keys rarely contend:
+//
+//	m := safemap.New[string, int]()
+//	m.Set("worker_1_add", 1)
+//	v, ok := m.Get("worker_1_add")
+package safemap
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Option configures a SafeMap
+type Option func(*config)
+
+type config struct {
+	shards  int
+	history int
+}
+
+// WithShards sets the number of shards, rounded up to a power of two.
+// The default is four per CPU.
+func WithShards(n int) Option {
+	return func(c *config) { c.shards = n }
+}
+
+// WithWatchHistory sets how many of the latest changes each shard keeps
+// for watchers that fall behind or resume (default 1024)
+func WithWatchHistory(n int) Option {
+	return func(c *config) { c.history = n }
+}
+
+// SafeMap is a map safe for concurrent use
+type SafeMap[K comparable, V any] struct {
+	seed   maphash.Seed
+	mask   uint64
+	shards []shard[K, V]
+
+	history int
+	hub     atomic.Pointer[hub[K, V]] // set while someone watches
+
+	watchMu sync.Mutex  // guards creating and dropping hub, and the fields below
+	lastRev uint64      // revision the last hub reached
+	watched bool        // a hub has existed
+	changed atomic.Bool // written while nobody watched
+}
+
+type shard[K comparable, V any] struct {
+	sync.RWMutex
+	data  map[K]V
+	calls map[K]*call[V] // GetOrCompute computations in progress
+	ring  *ring[K, V]    // recent changes, while someone watches
+	_     [16]byte       // keep neighbouring shards' locks off the same cache line
+}
+
+// New returns an empty map
+func New[K comparable, V any](opts ...Option) *SafeMap[K, V] {
+	cfg := config{shards: 4 * runtime.GOMAXPROCS(0), history: 1024}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	n := 1 << bits.Len(uint(max(cfg.shards, 1)-1))
+
+	m := &SafeMap[K, V]{
+		seed:   maphash.MakeSeed(),
+		mask:   uint64(n - 1),
+		shards: make([]shard[K, V], n),
+
+		history: max(cfg.history, 1),
+	}
+	for i := range m.shards {
+		m.shards[i].data = make(map[K]V)
+		m.shards[i].calls = make(map[K]*call[V])
+	}
+	return m
+}
+
+func (m *SafeMap[K, V]) index(key K) uint64 {
+	return maphash.Comparable(m.seed, key) & m.mask
+}
+
+func (m *SafeMap[K, V]) shard(key K) *shard[K, V] {
+	return &m.shards[m.index(key)]
+}
+
+// Set stores value under key
+func (m *SafeMap[K, V]) Set(key K, value V) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	m.store(s, key, value)
+}
+
+// Get returns the value under key and whether there was one
+func (m *SafeMap[K, V]) Get(key K) (V, bool) {
+	s := m.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// Delete removes key
+func (m *SafeMap[K, V]) Delete(key K) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	m.remove(s, key)
+}
+
+// Len returns the number of keys. Writes running at the same time may or
+// may not be counted.
+func (m *SafeMap[K, V]) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += len(s.data)
+		s.RUnlock()
+	}
+	return n
+}
+
+// Range calls fn for every key until it returns false. Each shard is
+// copied under its lock and fn runs unlocked, so fn may use the map; a
+// key written during Range may or may not be seen.
+func (m *SafeMap[K, V]) Range(fn func(key K, value V) bool) {
+	type entry struct {
+		key   K
+		value V
+	}
+	var entries []entry
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		entries = entries[:0]
+		for k, v := range s.data {
+			entries = append(entries, entry{k, v})
+		}
+		s.RUnlock()
+
+		for _, e := range entries {
+			if !fn(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// Clear removes every key
+func (m *SafeMap[K, V]) Clear() {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.Lock()
+		if m.hub.Load() != nil {
+			for k := range s.data {
+				m.remove(s, k)
+			}
+		}
+		clear(s.data)
+		s.Unlock()
+	}
+}
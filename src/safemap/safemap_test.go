@@ -0,0 +1,483 @@
+package safemap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSafeMap(t *testing.T) {
+	m := New[string, int](WithShards(5))
+	if len(m.shards) != 8 {
+		t.Fatalf("%d shards, want 5 rounded up to 8", len(m.shards))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("worker_%d_%d", w, i)
+				m.Set(key, i)
+				if v, ok := m.Get(key); !ok || v != i {
+					t.Errorf("Get(%q) = %d, %v", key, v, ok)
+				}
+				if i%2 == 1 {
+					m.Delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := m.Len(); n != 8*500 {
+		t.Fatalf("Len = %d, want %d", n, 8*500)
+	}
+	seen := 0
+	m.Range(func(key string, value int) bool {
+		if value%2 != 0 {
+			t.Fatalf("deleted key %s still there", key)
+		}
+		m.Delete(key) // fn may use the map
+		seen++
+		return true
+	})
+	if seen != 8*500 || m.Len() != 0 {
+		t.Fatalf("ranged over %d keys, %d left", seen, m.Len())
+	}
+
+	m.Set("a", 1)
+	m.Clear()
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("Clear left a key behind")
+	}
+}
+
+func TestAtomicOps(t *testing.T) {
+	m := New[string, int]()
+
+	// Read-modify-write from many goroutines loses no increments
+	var wg sync.WaitGroup
+	for w := 0; w < 20; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.Update("count", func(old int, ok bool) (int, bool) { return old + 1, true })
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("count"); v != 2000 {
+		t.Fatalf("count = %d, want 2000", v)
+	}
+	if _, keep := m.Update("count", func(int, bool) (int, bool) { return 0, false }); keep || m.Len() != 0 {
+		t.Fatal("Update returning false should delete the key")
+	}
+
+	if m.CompareAndSwap("a", 0, 1) {
+		t.Fatal("CompareAndSwap on a missing key succeeded")
+	}
+	if v, loaded := m.LoadOrStore("a", 1); v != 1 || loaded {
+		t.Fatalf("LoadOrStore stored %d, loaded %v", v, loaded)
+	}
+	if v, loaded := m.LoadOrStore("a", 2); v != 1 || !loaded {
+		t.Fatalf("LoadOrStore on an existing key: %d, %v", v, loaded)
+	}
+	if m.CompareAndSwap("a", 5, 6) || !m.CompareAndSwap("a", 1, 7) {
+		t.Fatal("CompareAndSwap compared wrong")
+	}
+
+	m.Set("b", 2)
+	m.Swap("a", "b")
+	m.Swap("b", "missing")
+	va, _ := m.Get("a")
+	_, okB := m.Get("b")
+	vm, _ := m.Get("missing")
+	if va != 2 || okB || vm != 7 {
+		t.Fatalf("after swaps a=%d b present=%v missing=%d", va, okB, vm)
+	}
+}
+
+func TestGetOrComputeSharesOneCall(t *testing.T) {
+	m := New[string, int]()
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]int, 20)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := m.GetOrCompute("expensive", func() (int, error) {
+				calls.Add(1)
+				<-release
+				return 42, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // let every caller find the call in progress
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("fn ran %d times", calls.Load())
+	}
+	for _, v := range results {
+		if v != 42 {
+			t.Fatalf("results %v", results)
+		}
+	}
+
+	// Failures are not cached
+	boom := errors.New("boom")
+	if _, err := m.GetOrCompute("flaky", func() (int, error) { return 0, boom }); !errors.Is(err, boom) {
+		t.Fatalf("err = %v", err)
+	}
+	if v, err := m.GetOrCompute("flaky", func() (int, error) { return 1, nil }); v != 1 || err != nil {
+		t.Fatalf("retry got %d, %v", v, err)
+	}
+
+	// A key deleted while fn runs stays deleted
+	v, err := m.GetOrCompute("gone", func() (int, error) {
+		m.Set("gone", 1)
+		m.Delete("gone")
+		return 2, nil
+	})
+	if _, ok := m.Get("gone"); ok || v != 2 || err != nil {
+		t.Fatalf("got %d, %v; key still there: %v", v, err, ok)
+	}
+}
+
+func TestTransferKeepsTotal(t *testing.T) {
+	m := New[int, int](WithShards(4))
+	for acct := 0; acct < 10; acct++ {
+		m.Set(acct, 100)
+	}
+	errShort := errors.New("insufficient funds")
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(w), 0))
+			for i := 0; i < 500; i++ {
+				from, to, amount := r.IntN(10), r.IntN(10), r.IntN(50)
+				if from == to {
+					continue
+				}
+				m.Transfer(from, to, func(a, b int) (int, int, error) {
+					if a < amount {
+						return a, b, errShort
+					}
+					return a - amount, b + amount, nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	m.Range(func(acct, balance int) bool {
+		if balance < 0 {
+			t.Errorf("account %d overdrawn: %d", acct, balance)
+		}
+		total += balance
+		return true
+	})
+	if total != 1000 {
+		t.Fatalf("total = %d, want 1000", total)
+	}
+	if err := m.Transfer(1, 1, func(a, b int) (int, int, error) { return a, b, nil }); err == nil {
+		t.Fatal("Transfer to the same key should fail")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	m := New[string, int]()
+	m.Set("before", 1) // not watched yet
+	w := m.Watch(ctx, "a")
+	defer w.Close()
+	pw := m.WatchPrefix(ctx, "worker_")
+	defer pw.Close()
+
+	m.Set("a", 1)
+	m.Set("worker_1", 10)
+	m.Update("a", func(old int, _ bool) (int, bool) { return old + 1, true })
+	m.Set("other", 0)
+	m.Swap("worker_1", "worker_2")
+	m.Delete("a")
+	m.Clear()
+
+	got := func(w *Watcher[string, int], n int) string {
+		var evs []string
+		for i := 0; i < n; i++ {
+			e := <-w.C
+			evs = append(evs, fmt.Sprintf("%d:%s %s %d(%v)->%d", e.Rev, e.Type, e.Key, e.Old, e.HadOld, e.New))
+		}
+		return fmt.Sprint(evs)
+	}
+	if s, want := got(w, 3), "[1:put a 0(false)->1 3:put a 1(true)->2 7:delete a 2(true)->0]"; s != want {
+		t.Fatalf("Watch got %s, want %s", s, want)
+	}
+	want := "[2:put worker_1 0(false)->10 5:put worker_2 0(false)->10 6:delete worker_1 10(true)->0]"
+	if s := got(pw, 3); s != want {
+		t.Fatalf("WatchPrefix got %s, want %s", s, want)
+	}
+	// Clear deletes before, other and worker_2 in shard order
+	if e := <-pw.C; e.Type != Delete || e.Key != "worker_2" || e.Rev < 8 {
+		t.Fatalf("Clear sent %+v", e)
+	}
+	if m.Rev() != 10 {
+		t.Fatalf("Rev = %d, want 10", m.Rev())
+	}
+
+	// Resume after the last event seen, missing nothing written meanwhile
+	w.Close()
+	m.Set("a", 5)
+	m.Delete("a")
+	r := m.Watch(ctx, "a", After(7))
+	defer r.Close()
+	if s := got(r, 2); s != "[11:put a 0(false)->5 12:delete a 5(true)->0]" {
+		t.Fatalf("resumed watch got %s", s)
+	}
+
+	// Waiting for a key to appear
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.Set("ready", 1)
+	}()
+	ready := m.Watch(ctx, "ready")
+	if _, ok := m.Get("ready"); !ok {
+		if e := <-ready.C; e.New != 1 {
+			t.Fatalf("ready event %+v", e)
+		}
+	}
+	ready.Close()
+	if _, ok := <-ready.C; ok {
+		t.Fatal("C still open after Close")
+	}
+}
+
+func TestSlowWatcherDoesNotBlockWriters(t *testing.T) {
+	m := New[int, int](WithWatchHistory(16))
+	w := m.WatchPrefix(context.Background(), "") // int keys: never matches
+	slow := m.Watch(context.Background(), 1)
+	defer w.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			m.Set(1, i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writers blocked on a watcher that does not read")
+	}
+
+	// The watcher finds it has been lapped, after at most the event it
+	// was trying to send
+	n := 0
+	for range slow.C {
+		n++
+	}
+	if n > 1 || !errors.Is(slow.Err(), ErrCompacted) {
+		t.Fatalf("received %d events, err %v", n, slow.Err())
+	}
+	select {
+	case e, ok := <-w.C:
+		if ok {
+			t.Fatalf("prefix watch on int keys got %+v", e)
+		}
+	default:
+	}
+}
+
+func TestWatchersSeeEveryShardInOrder(t *testing.T) {
+	m := New[string, int](WithWatchHistory(4096))
+	w := m.WatchPrefix(context.Background(), "")
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				m.Set(fmt.Sprintf("worker_%d_%d", g, i%20), i)
+			}
+		}()
+	}
+	wg.Wait()
+	for rev := uint64(1); rev <= 1600; rev++ {
+		if e := <-w.C; e.Rev != rev {
+			t.Fatalf("got revision %d, want %d", e.Rev, rev)
+		}
+	}
+}
+
+func TestLastWatcherDropsHistory(t *testing.T) {
+	ctx := context.Background()
+	m := New[string, int]()
+	w := m.Watch(ctx, "a")
+	m.Set("a", 1)
+	m.Set("a", 2)
+	if e := <-w.C; e.Rev != 1 {
+		t.Fatalf("first event %+v", e)
+	}
+	w.Close()
+	deadline := time.Now().Add(time.Second)
+	for m.hub.Load() != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m.shards[0].RLock()
+	ring := m.shards[0].ring
+	m.shards[0].RUnlock()
+	if m.hub.Load() != nil || ring != nil {
+		t.Fatal("history kept with nobody watching")
+	}
+	if m.Rev() != 2 {
+		t.Fatalf("Rev = %d, want 2", m.Rev())
+	}
+
+	// What changed meanwhile was not recorded, so resuming from before
+	// it fails; numbering carries on from the last watch
+	m.Set("a", 3)
+	m.Delete("a")
+	rev := m.Rev()
+	if rev != 3 {
+		t.Fatalf("Rev = %d after unwatched writes, want 3", rev)
+	}
+	old := m.Watch(ctx, "a", After(1))
+	if _, ok := <-old.C; ok || !errors.Is(old.Err(), ErrCompacted) {
+		t.Fatalf("resumed across unwatched writes: err %v", old.Err())
+	}
+	r := m.Watch(ctx, "a", After(rev))
+	defer r.Close()
+	m.Set("a", 4)
+	if e := <-r.C; e.Rev != 4 || e.New != 4 || e.HadOld {
+		t.Fatalf("event %+v after the history was dropped", e)
+	}
+}
+
+// The maps under comparison, behind one interface
+type benchMap interface {
+	Set(key string, value int)
+	Get(key string) (int, bool)
+}
+
+// legacyMap is the single-lock SafeMap from map_scenarios.go
+type legacyMap struct {
+	sync.RWMutex
+	data map[string]int
+}
+
+func (sm *legacyMap) Set(key string, value int) {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.data[key] = value
+}
+
+func (sm *legacyMap) Get(key string) (int, bool) {
+	sm.RLock()
+	defer sm.RUnlock()
+	val, exists := sm.data[key]
+	return val, exists
+}
+
+type mutexMap struct {
+	mu   sync.Mutex
+	data map[string]int
+}
+
+func (m *mutexMap) Set(key string, value int) {
+	m.mu.Lock()
+	m.data[key] = value
+	m.mu.Unlock()
+}
+
+func (m *mutexMap) Get(key string) (int, bool) {
+	m.mu.Lock()
+	v, ok := m.data[key]
+	m.mu.Unlock()
+	return v, ok
+}
+
+type syncMap struct{ m sync.Map }
+
+func (m *syncMap) Set(key string, value int) { m.m.Store(key, value) }
+
+func (m *syncMap) Get(key string) (int, bool) {
+	v, ok := m.m.Load(key)
+	if !ok {
+		return 0, false
+	}
+	return v.(int), true
+}
+
+// BenchmarkMaps runs every map under read-heavy, mixed and write-heavy
+// loads from parallel goroutines:
+//
+//	go test -bench Maps -cpu 1,4,16
+func BenchmarkMaps(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("worker_%d_op_%d", i%16, i)
+	}
+	maps := []struct {
+		name string
+		make func() benchMap
+	}{
+		{"SafeMap", func() benchMap { return New[string, int]() }},
+		{"legacy", func() benchMap { return &legacyMap{data: make(map[string]int)} }},
+		{"mutex", func() benchMap { return &mutexMap{data: make(map[string]int)} }},
+		{"sync.Map", func() benchMap { return &syncMap{} }},
+	}
+	loads := []struct {
+		name  string
+		reads int // out of 100 operations
+	}{
+		{"read-heavy", 90},
+		{"mixed", 50},
+		{"write-heavy", 10},
+	}
+
+	for _, load := range loads {
+		for _, mm := range maps {
+			b.Run(load.name+"/"+mm.name, func(b *testing.B) {
+				m := mm.make()
+				for i, k := range keys {
+					m.Set(k, i)
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+					for pb.Next() {
+						k := keys[r.IntN(len(keys))]
+						if r.IntN(100) < load.reads {
+							m.Get(k)
+						} else {
+							m.Set(k, 1)
+						}
+					}
+				})
+			})
+		}
+	}
+}
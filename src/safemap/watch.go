@@ -0,0 +1,396 @@
+package safemap
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCompacted is the Err of a watcher that fell so far behind that the
+// events it needed are no longer kept. Read the map again and watch from
+// Rev.
+var ErrCompacted = errors.New("safemap: watch revision compacted")
+
+// EventType says what happened to a key
+type EventType int
+
+const (
+	Put    EventType = iota // the key was set
+	Delete                  // the key was removed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Put:
+		return "put"
+	case Delete:
+		return "delete"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is one change to a watched key
+type Event[K comparable, V any] struct {
+	Type   EventType
+	Key    K
+	Old    V
+	HadOld bool // whether the key had a value before
+	New    V    // zero for Delete
+	Rev    uint64
+}
+
+// hub numbers the changes made while someone watches. The first Watch
+// creates it and the last watcher to leave drops it, so a map nobody
+// watches pays one atomic load per write.
+//
+// Writers take a revision from an atomic counter and record the event in
+// the history of their own shard, under the shard lock they already
+// hold; writers to different shards share nothing but the counter.
+type hub[K comparable, V any] struct {
+	rev   atomic.Uint64
+	start uint64 // revision the hub started from
+	size  int    // events each shard keeps
+	rings []*ring[K, V]
+
+	wake     atomic.Pointer[chan struct{}] // closed on the next change
+	watchers int                           // guarded by SafeMap.watchMu
+}
+
+// ring is the history of one shard, guarded by the shard lock. Events
+// are in revision order starting at pos once the ring is full.
+type ring[K comparable, V any] struct {
+	events []Event[K, V]
+	pos    int
+	lost   uint64 // revision of the newest event dropped to make room
+}
+
+func (r *ring[K, V]) add(e Event[K, V], size int) {
+	if len(r.events) < size {
+		r.events = append(r.events, e)
+		return
+	}
+	r.lost = r.events[r.pos].Rev
+	r.events[r.pos] = e
+	r.pos = (r.pos + 1) % size
+}
+
+// collect appends the events from revision from to to that match
+func (r *ring[K, V]) collect(batch []Event[K, V], from, to uint64, match func(K) bool) []Event[K, V] {
+	n := len(r.events)
+	at := func(i int) Event[K, V] { return r.events[(r.pos+i)%n] }
+	for i := sort.Search(n, func(i int) bool { return at(i).Rev >= from }); i < n; i++ {
+		e := at(i)
+		if e.Rev > to {
+			break
+		}
+		if match(e.Key) {
+			batch = append(batch, e)
+		}
+	}
+	return batch
+}
+
+// publish numbers e and records it in r; the caller holds r's shard lock
+func (h *hub[K, V]) publish(r *ring[K, V], e Event[K, V]) {
+	e.Rev = h.rev.Add(1)
+	r.add(e, h.size)
+	if h.wake.Load() != nil {
+		if wake := h.wake.Swap(nil); wake != nil {
+			close(*wake)
+		}
+	}
+}
+
+// waiter returns a channel closed by the next change. The caller must
+// check the revision again after getting it, or it can miss a change
+// made in between.
+func (h *hub[K, V]) waiter() <-chan struct{} {
+	for {
+		if wake := h.wake.Load(); wake != nil {
+			return *wake
+		}
+		wake := make(chan struct{})
+		if h.wake.CompareAndSwap(nil, &wake) {
+			return wake
+		}
+	}
+}
+
+// join returns the hub for a new watcher, creating it if nobody watches.
+// All shards are locked meanwhile, so every write either happens before
+// the hub exists or is recorded in it.
+func (m *SafeMap[K, V]) join() *hub[K, V] {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	h := m.hub.Load()
+	if h == nil {
+		h = &hub[K, V]{start: m.nextRev(), size: m.history, rings: make([]*ring[K, V], len(m.shards))}
+		h.rev.Store(h.start)
+		m.lockAll()
+		for i := range m.shards {
+			h.rings[i] = &ring[K, V]{}
+			m.shards[i].ring = h.rings[i]
+		}
+		m.changed.Store(false)
+		m.hub.Store(h)
+		m.unlockAll()
+	}
+	h.watchers++
+	return h
+}
+
+// leave drops the hub once its last watcher has gone
+func (m *SafeMap[K, V]) leave(h *hub[K, V]) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	if h.watchers--; h.watchers > 0 {
+		return
+	}
+	m.lockAll()
+	m.hub.Store(nil)
+	for i := range m.shards {
+		m.shards[i].ring = nil
+	}
+	m.unlockAll()
+	m.lastRev, m.watched = h.rev.Load(), true
+}
+
+// nextRev is the revision a new hub starts from. Changes made while
+// nobody watched are not numbered; together they count as one revision,
+// so a watcher resuming from before them finds it was compacted. The
+// caller holds watchMu.
+func (m *SafeMap[K, V]) nextRev() uint64 {
+	if m.watched && m.changed.Load() {
+		return m.lastRev + 1
+	}
+	return m.lastRev
+}
+
+func (m *SafeMap[K, V]) lockAll() {
+	for i := range m.shards {
+		m.shards[i].Lock()
+	}
+}
+
+func (m *SafeMap[K, V]) unlockAll() {
+	for i := range m.shards {
+		m.shards[i].Unlock()
+	}
+}
+
+// store sets key in s, which the caller has locked, and tells watchers
+// and any GetOrCompute running for key
+func (m *SafeMap[K, V]) store(s *shard[K, V], key K, value V) {
+	if c, ok := s.calls[key]; ok {
+		c.stale = true
+	}
+	if h := m.hub.Load(); h != nil {
+		old, ok := s.data[key]
+		h.publish(s.ring, Event[K, V]{Type: Put, Key: key, Old: old, HadOld: ok, New: value})
+	} else {
+		m.unwatchedChange()
+	}
+	s.data[key] = value
+}
+
+// remove deletes key from s, which the caller has locked, and tells
+// watchers and any GetOrCompute running for key
+func (m *SafeMap[K, V]) remove(s *shard[K, V], key K) {
+	if c, ok := s.calls[key]; ok {
+		c.stale = true
+	}
+	old, ok := s.data[key]
+	if !ok {
+		return
+	}
+	if h := m.hub.Load(); h != nil {
+		h.publish(s.ring, Event[K, V]{Type: Delete, Key: key, Old: old, HadOld: true})
+	} else {
+		m.unwatchedChange()
+	}
+	delete(s.data, key)
+}
+
+// unwatchedChange notes a write made while nobody watches; after the
+// first one it only reads
+func (m *SafeMap[K, V]) unwatchedChange() {
+	if !m.changed.Load() {
+		m.changed.Store(true)
+	}
+}
+
+// Rev returns the revision of the latest change. Changes are numbered
+// from the first Watch on, so it is 0 until then.
+func (m *SafeMap[K, V]) Rev() uint64 {
+	if h := m.hub.Load(); h != nil {
+		return h.rev.Load()
+	}
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	if h := m.hub.Load(); h != nil {
+		return h.rev.Load()
+	}
+	return m.nextRev()
+}
+
+// WatchOption configures a watcher
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	after   uint64
+	resumed bool
+}
+
+// After resumes a watch: events after revision rev are delivered, even
+// ones that happened before Watch was called, as long as the map still
+// keeps them. Pass the Rev of the last event seen.
+func After(rev uint64) WatchOption {
+	return func(c *watchConfig) {
+		c.after = rev
+		c.resumed = true
+	}
+}
+
+// Watcher delivers the changes to some keys of a map
+type Watcher[K comparable, V any] struct {
+	// C receives the changes in revision order. It is closed when the
+	// watcher is closed, its context is done or it falls behind.
+	C <-chan Event[K, V]
+
+	quit      chan struct{}
+	closeOnce sync.Once
+	compacted atomic.Bool
+}
+
+// Watch delivers every change to key made after Watch returns. To wait
+// for a value to appear, watch first and then Get, so a value set in
+// between is not missed.
+func (m *SafeMap[K, V]) Watch(ctx context.Context, key K, opts ...WatchOption) *Watcher[K, V] {
+	return m.watch(ctx, []int{int(m.index(key))}, func(k K) bool { return k == key }, opts)
+}
+
+// WatchPrefix delivers every change to keys starting with prefix. On a
+// map whose keys are not strings it delivers nothing.
+func (m *SafeMap[K, V]) WatchPrefix(ctx context.Context, prefix string, opts ...WatchOption) *Watcher[K, V] {
+	shards := make([]int, len(m.shards))
+	for i := range shards {
+		shards[i] = i
+	}
+	return m.watch(ctx, shards, func(k K) bool {
+		s, ok := keyString(k)
+		return ok && strings.HasPrefix(s, prefix)
+	}, opts)
+}
+
+func keyString[K comparable](key K) (string, bool) {
+	if s, ok := any(key).(string); ok {
+		return s, true
+	}
+	if v := reflect.ValueOf(key); v.Kind() == reflect.String {
+		return v.String(), true
+	}
+	return "", false
+}
+
+// watch starts a watcher over the given shards
+func (m *SafeMap[K, V]) watch(ctx context.Context, shards []int, match func(K) bool, opts []WatchOption) *Watcher[K, V] {
+	h := m.join()
+	var cfg watchConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.resumed {
+		cfg.after = h.rev.Load()
+	}
+
+	c := make(chan Event[K, V])
+	w := &Watcher[K, V]{C: c, quit: make(chan struct{})}
+	go func() {
+		defer m.leave(h)
+		w.run(ctx, m, h, shards, match, cfg.after+1, c)
+	}()
+	return w
+}
+
+// Close stops the watcher; C is closed soon after
+func (w *Watcher[K, V]) Close() {
+	w.closeOnce.Do(func() { close(w.quit) })
+}
+
+// Err returns ErrCompacted once the watcher has fallen behind and C is
+// closed. Resume with After and the Rev of the last event received, or
+// start over.
+func (w *Watcher[K, V]) Err() error {
+	if w.compacted.Load() {
+		return ErrCompacted
+	}
+	return nil
+}
+
+// run copies the events from next on out of the shards' histories and
+// sends them. It works from a copy, so writers never wait for a slow
+// watcher; one that is lapped by a history ends with ErrCompacted.
+//
+// Each round takes the latest revision first and then reads the shards.
+// A revision is handed out under the lock of the shard it belongs to, so
+// by the time the watcher gets that lock the event is recorded.
+func (w *Watcher[K, V]) run(ctx context.Context, m *SafeMap[K, V], h *hub[K, V], shards []int, match func(K) bool, next uint64, c chan<- Event[K, V]) {
+	defer close(c)
+	if next <= h.start {
+		w.compacted.Store(true)
+		return
+	}
+	for {
+		last := h.rev.Load()
+		var batch []Event[K, V]
+		for _, i := range shards {
+			s := &m.shards[i]
+			s.RLock()
+			r := h.rings[i]
+			lost := r.lost >= next
+			if !lost {
+				batch = r.collect(batch, next, last, match)
+			}
+			s.RUnlock()
+			if lost {
+				w.compacted.Store(true)
+				return
+			}
+		}
+		if len(shards) > 1 {
+			slices.SortFunc(batch, func(a, b Event[K, V]) int { return cmp.Compare(a.Rev, b.Rev) })
+		}
+		next = last + 1
+
+		for _, e := range batch {
+			select {
+			case c <- e:
+			case <-w.quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(batch) > 0 {
+			continue
+		}
+		wake := h.waiter()
+		if h.rev.Load() != last {
+			continue
+		}
+		select {
+		case <-wake:
+		case <-w.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Package timeline turns per-task start/end records into something you can
+// debug a parallel run with: Chrome Trace Event JSON (open it in
+// chrome://tracing or https://ui.perfetto.dev), an ASCII Gantt chart, and a
+// per-worker utilisation and idle-gap report.
+package timeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Span is one task run by one worker
+type Span struct {
+	Worker int
+	Task   int
+	Name   string // optional label, e.g. the task type
+	Start  time.Time
+	End    time.Time
+}
+
+// Duration returns how long the span ran
+func (s Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Gap is a stretch of time a worker spent idle
+type Gap struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Duration returns the length of the gap
+func (g Gap) Duration() time.Duration {
+	return g.End.Sub(g.Start)
+}
+
+// WorkerStats summarises one worker's share of the run
+type WorkerStats struct {
+	Worker      int
+	Tasks       int
+	Busy        time.Duration
+	Idle        time.Duration
+	Utilisation float64 // Busy / wall time of the whole run
+	Gaps        []Gap
+	LongestGap  time.Duration
+}
+
+// Report is the analysis of a whole run
+type Report struct {
+	Start   time.Time
+	End     time.Time
+	Wall    time.Duration
+	Busy    time.Duration // sum of all span durations
+	Speedup float64       // Busy / Wall: how many workers were effectively busy
+	Peak    int           // most spans running at the same moment
+	Workers []WorkerStats
+}
+
+// Analyze computes per-worker utilisation and idle gaps for spans
+func Analyze(spans []Span) Report {
+	var r Report
+	if len(spans) == 0 {
+		return r
+	}
+
+	r.Start, r.End = spans[0].Start, spans[0].End
+	byWorker := map[int][]Span{}
+	for _, s := range spans {
+		if s.Start.Before(r.Start) {
+			r.Start = s.Start
+		}
+		if s.End.After(r.End) {
+			r.End = s.End
+		}
+		r.Busy += s.Duration()
+		byWorker[s.Worker] = append(byWorker[s.Worker], s)
+	}
+	r.Wall = r.End.Sub(r.Start)
+	if r.Wall > 0 {
+		r.Speedup = float64(r.Busy) / float64(r.Wall)
+	}
+	r.Peak = peak(spans)
+
+	for worker, ws := range byWorker {
+		sort.Slice(ws, func(i, j int) bool { return ws[i].Start.Before(ws[j].Start) })
+
+		st := WorkerStats{Worker: worker, Tasks: len(ws)}
+		cursor := r.Start
+		for _, s := range ws {
+			if s.Start.After(cursor) {
+				st.Gaps = append(st.Gaps, Gap{Start: cursor, End: s.Start})
+			}
+			st.Busy += s.Duration()
+			if s.End.After(cursor) {
+				cursor = s.End
+			}
+		}
+		if r.End.After(cursor) {
+			st.Gaps = append(st.Gaps, Gap{Start: cursor, End: r.End})
+		}
+		for _, g := range st.Gaps {
+			st.Idle += g.Duration()
+			st.LongestGap = max(st.LongestGap, g.Duration())
+		}
+		if r.Wall > 0 {
+			st.Utilisation = float64(st.Busy) / float64(r.Wall)
+		}
+		r.Workers = append(r.Workers, st)
+	}
+	sort.Slice(r.Workers, func(i, j int) bool { return r.Workers[i].Worker < r.Workers[j].Worker })
+	return r
+}
+
+// peak sweeps span start/end events to find the maximum overlap
+func peak(spans []Span) int {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := make([]event, 0, 2*len(spans))
+	for _, s := range spans {
+		events = append(events, event{s.Start, 1}, event{s.End, -1})
+	}
+	// Ends sort before starts at the same instant, so back-to-back spans
+	// on one worker do not count as overlapping
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at.Equal(events[j].at) {
+			return events[i].delta < events[j].delta
+		}
+		return events[i].at.Before(events[j].at)
+	})
+
+	running, most := 0, 0
+	for _, e := range events {
+		running += e.delta
+		most = max(most, running)
+	}
+	return most
+}
+
+// Print writes the report as a text table
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Wall time:   %v\n", r.Wall.Round(time.Millisecond))
+	fmt.Fprintf(w, "Busy time:   %v\n", r.Busy.Round(time.Millisecond))
+	fmt.Fprintf(w, "Speedup:     %.2fx (peak %d tasks at once)\n", r.Speedup, r.Peak)
+	fmt.Fprintf(w, "\n%-8s %6s %10s %10s %7s %5s %12s\n", "Worker", "Tasks", "Busy", "Idle", "Util", "Gaps", "Longest gap")
+	for _, st := range r.Workers {
+		fmt.Fprintf(w, "%-8d %6d %10v %10v %6.1f%% %5d %12v\n",
+			st.Worker, st.Tasks,
+			st.Busy.Round(time.Millisecond), st.Idle.Round(time.Millisecond),
+			st.Utilisation*100, len(st.Gaps), st.LongestGap.Round(time.Millisecond))
+	}
+}
+
+// traceEvent is one entry of the Chrome Trace Event format
+type traceEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	Ts   float64        `json:"ts"`            // microseconds
+	Dur  float64        `json:"dur,omitempty"` // microseconds
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes spans as Chrome Trace Event JSON, one track per
+// worker
+func WriteChromeTrace(w io.Writer, spans []Span) error {
+	r := Analyze(spans)
+	events := make([]traceEvent, 0, len(spans)+len(r.Workers))
+
+	for _, st := range r.Workers {
+		events = append(events, traceEvent{
+			Name: "thread_name",
+			Ph:   "M",
+			Pid:  1,
+			Tid:  st.Worker,
+			Args: map[string]any{"name": fmt.Sprintf("worker %d", st.Worker)},
+		})
+	}
+	for _, s := range spans {
+		name := fmt.Sprintf("task %d", s.Task)
+		if s.Name != "" {
+			name = fmt.Sprintf("%s (%s)", name, s.Name)
+		}
+		events = append(events, traceEvent{
+			Name: name,
+			Cat:  s.Name,
+			Ph:   "X",
+			Ts:   micros(s.Start.Sub(r.Start)),
+			Dur:  micros(s.Duration()),
+			Pid:  1,
+			Tid:  s.Worker,
+			Args: map[string]any{"task": s.Task},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{
+		"traceEvents":     events,
+		"displayTimeUnit": "ms",
+	})
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// WriteGantt draws one row per worker, width characters wide. Each task is
+// drawn with the last character of its ID in base 36, idle time as '.'.
+func WriteGantt(w io.Writer, spans []Span, width int) error {
+	r := Analyze(spans)
+	if r.Wall <= 0 || width < 1 {
+		_, err := fmt.Fprintln(w, "(empty timeline)")
+		return err
+	}
+
+	col := func(t time.Time) int {
+		c := int(float64(t.Sub(r.Start)) / float64(r.Wall) * float64(width))
+		return min(max(c, 0), width-1)
+	}
+
+	rows := map[int][]byte{}
+	for _, st := range r.Workers {
+		rows[st.Worker] = []byte(strings.Repeat(".", width))
+	}
+	for _, s := range spans {
+		id := strconv.FormatInt(int64(s.Task), 36)
+		mark := id[len(id)-1]
+		for c := col(s.Start); c <= col(s.End.Add(-time.Nanosecond)); c++ {
+			rows[s.Worker][c] = mark
+		}
+	}
+
+	fmt.Fprintf(w, "%-10s|%s| %v\n", "", strings.Repeat("-", width), r.Wall.Round(time.Millisecond))
+	for _, st := range r.Workers {
+		if _, err := fmt.Fprintf(w, "worker %-3d|%s| %5.1f%%\n", st.Worker, rows[st.Worker], st.Utilisation*100); err != nil {
+			return err
+		}
+	}
+	return nil
+}
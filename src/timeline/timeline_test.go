@@ -0,0 +1,45 @@
+package timeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeUtilisationAndGaps(t *testing.T) {
+	t0 := time.Now()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	spans := []Span{
+		{Worker: 1, Task: 1, Start: at(0), End: at(100)},
+		{Worker: 1, Task: 3, Start: at(150), End: at(200)},
+		{Worker: 2, Task: 2, Start: at(0), End: at(200)},
+	}
+
+	r := Analyze(spans)
+	if r.Wall != 200*time.Millisecond || r.Peak != 2 || r.Speedup != 1.75 {
+		t.Errorf("wall %v, peak %d, speedup %.2f; expected 200ms, 2, 1.75", r.Wall, r.Peak, r.Speedup)
+	}
+	w1 := r.Workers[0]
+	if w1.Utilisation != 0.75 || len(w1.Gaps) != 1 || w1.LongestGap != 50*time.Millisecond {
+		t.Errorf("worker 1: %+v", w1)
+	}
+
+	var trace bytes.Buffer
+	if err := WriteChromeTrace(&trace, spans); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		TraceEvents []map[string]any `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(trace.Bytes(), &doc); err != nil || len(doc.TraceEvents) != 5 {
+		t.Errorf("trace has %d events (%v); expected 3 spans + 2 thread names", len(doc.TraceEvents), err)
+	}
+
+	var gantt bytes.Buffer
+	WriteGantt(&gantt, spans, 20)
+	if !strings.Contains(gantt.String(), "|1111111111.....33333|") {
+		t.Errorf("unexpected gantt chart:\n%s", gantt.String())
+	}
+}
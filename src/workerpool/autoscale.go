@@ -0,0 +1,185 @@
+package workerpool
+
+import (
+	"math"
+	"time"
+)
+
+// AutoscaleConfig bounds and tunes the autoscaler
+type AutoscaleConfig struct {
+	Min int
+	Max int
+
+	// Interval is how often the controller looks at the pool (default 100ms)
+	Interval time.Duration
+
+	// TargetLatency is how long the current backlog may take to drain before
+	// more workers are added (default 1s)
+	TargetLatency time.Duration
+
+	// Minimum time between two scale-ups and between two scale-downs
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+
+	// OnScale is called from the controller goroutine after every change
+	OnScale func(ScaleEvent)
+}
+
+// ScaleEvent describes one change in the number of workers
+type ScaleEvent struct {
+	Time        time.Time
+	From        int
+	To          int
+	Backlog     int
+	InFlight    int
+	AvgDuration time.Duration
+}
+
+// WithAutoscale lets the pool grow and shrink between cfg.Min and cfg.Max
+// workers. The workers argument to New becomes the starting size.
+func WithAutoscale(cfg AutoscaleConfig) Option {
+	if cfg.Min < 1 {
+		cfg.Min = 1
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 100 * time.Millisecond
+	}
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = time.Second
+	}
+	return func(c *config) { c.autoscale = &cfg }
+}
+
+// Backlog returns the number of jobs queued or waiting in Submit
+func (p *Pool[In, Out]) Backlog() int {
+	return len(p.jobs) + int(p.waiting.Load())
+}
+
+// InFlight returns the number of jobs currently being processed
+func (p *Pool[In, Out]) InFlight() int {
+	return int(p.inFlight.Load())
+}
+
+// AvgDuration returns the moving average of job processing time
+func (p *Pool[In, Out]) AvgDuration() time.Duration {
+	return time.Duration(p.avgNanos.Load())
+}
+
+// observe folds one job duration into the moving average
+func (p *Pool[In, Out]) observe(d time.Duration) {
+	const weight = 0.2
+	for {
+		old := p.avgNanos.Load()
+		next := int64(d)
+		if old != 0 {
+			next = int64(weight*float64(d) + (1-weight)*float64(old))
+		}
+		if p.avgNanos.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// desiredWorkers estimates how many workers are needed to finish the work
+// in the pool within the target latency
+func (p *Pool[In, Out]) desiredWorkers(current, backlog, inFlight int, avg time.Duration) int {
+	cfg := p.cfg.autoscale
+
+	var desired int
+	if avg == 0 {
+		// Nothing finished yet: grow one step at a time while work is waiting
+		desired = current
+		if backlog > 0 {
+			desired++
+		}
+	} else {
+		work := float64(backlog+inFlight) * float64(avg)
+		desired = int(math.Ceil(work / float64(cfg.TargetLatency)))
+	}
+
+	return min(max(desired, cfg.Min), cfg.Max)
+}
+
+// autoscale runs until the pool is closed or stopped. New counts it in
+// p.wg, so the workers it starts are never added after the pool is done.
+func (p *Pool[In, Out]) autoscale() {
+	defer p.wg.Done()
+	cfg := p.cfg.autoscale
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	var lastUp, lastDown time.Time
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.closing:
+			return
+		case <-ticker.C:
+		}
+
+		backlog, inFlight, avg := p.Backlog(), p.InFlight(), p.AvgDuration()
+		current := int(p.target.Load())
+		desired := p.desiredWorkers(current, backlog, inFlight, avg)
+		now := time.Now()
+
+		to := current
+		switch {
+		case desired > current && now.Sub(lastUp) >= cfg.ScaleUpCooldown:
+			to = desired
+			lastUp = now
+		case desired < current && now.Sub(lastDown) >= cfg.ScaleDownCooldown:
+			// Shrink gently; a burst may be about to arrive
+			to = current - 1
+			lastDown = now
+		}
+		if to == current || !p.resize(current, to) {
+			continue
+		}
+
+		if cfg.OnScale != nil {
+			cfg.OnScale(ScaleEvent{
+				Time:        now,
+				From:        current,
+				To:          to,
+				Backlog:     backlog,
+				InFlight:    inFlight,
+				AvgDuration: avg,
+			})
+		}
+	}
+}
+
+// resize starts or retires workers. Retired workers finish their current
+// job first. It returns false once the pool is closing or stopped.
+func (p *Pool[In, Out]) resize(from, to int) bool {
+	p.mu.RLock()
+	if p.closed || p.ctx.Err() != nil {
+		p.mu.RUnlock()
+		return false
+	}
+	for i := from; i < to; i++ {
+		// A retirement no busy worker has picked up yet cancels out
+		// one new worker
+		select {
+		case <-p.shrink:
+		default:
+			p.startWorker()
+		}
+	}
+	p.target.Store(int64(to))
+	p.mu.RUnlock()
+
+	// Busy workers pick these up after their job. Fewer than Max can be
+	// pending, so the send never has to wait.
+	for i := to; i < from; i++ {
+		select {
+		case p.shrink <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
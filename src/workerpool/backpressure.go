@@ -0,0 +1,291 @@
+package workerpool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrResultsFull is reported by the FailWithError policy
+var ErrResultsFull = errors.New("workerpool: results buffer full")
+
+// OverflowPolicy decides what a worker does when the results buffer is full
+type OverflowPolicy int
+
+const (
+	Block         OverflowPolicy = iota // wait for the consumer (default)
+	DropNewest                          // discard the result that did not fit
+	DropOldest                          // evict the oldest buffered result to make room
+	SpillToDisk                         // park the result in a file and replay it later
+	FailWithError                       // stop the pool and report ErrResultsFull
+)
+
+func (o OverflowPolicy) String() string {
+	switch o {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case SpillToDisk:
+		return "spill-to-disk"
+	case FailWithError:
+		return "fail-with-error"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(o))
+}
+
+// WithOverflowPolicy selects how full result buffers are handled
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(c *config) { c.overflow = policy }
+}
+
+// WithSpillDir sets where SpillToDisk writes its overflow file.
+// The default is os.TempDir().
+func WithSpillDir(dir string) Option {
+	return func(c *config) { c.spillDir = dir }
+}
+
+// Stats counts how many results each overflow policy affected
+type Stats struct {
+	Blocked       int64 // results that waited for buffer space
+	DroppedNewest int64
+	DroppedOldest int64
+	Spilled       int64
+	Failed        int64
+
+	// Kinds reports per-kind limits when a dispatcher with a Limiter
+	// feeds the pool
+	Kinds []KindStats
+}
+
+type counters struct {
+	blocked       atomic.Int64
+	droppedNewest atomic.Int64
+	droppedOldest atomic.Int64
+	spilled       atomic.Int64
+	failed        atomic.Int64
+}
+
+// Stats returns a snapshot of the overflow counters and per-kind limits
+func (p *Pool[In, Out]) Stats() Stats {
+	s := Stats{
+		Blocked:       p.stats.blocked.Load(),
+		DroppedNewest: p.stats.droppedNewest.Load(),
+		DroppedOldest: p.stats.droppedOldest.Load(),
+		Spilled:       p.stats.spilled.Load(),
+		Failed:        p.stats.failed.Load(),
+	}
+	if l := p.limiter.Load(); l != nil {
+		s.Kinds = l.Stats()
+	}
+	return s
+}
+
+// reportLimits makes Stats include l's per-kind counters
+func (p *Pool[In, Out]) reportLimits(l *Limiter) {
+	p.limiter.Store(l)
+}
+
+// Err returns the error that stopped the pool, if any
+func (p *Pool[In, Out]) Err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+// deliver sends res according to the overflow policy.
+// It returns false when the worker should exit.
+func (p *Pool[In, Out]) deliver(res Result[Out]) bool {
+	// Fast path: there is room in the buffer
+	select {
+	case p.results <- res:
+		return true
+	default:
+	}
+
+	switch p.cfg.overflow {
+	case DropNewest:
+		p.stats.droppedNewest.Add(1)
+		return true
+
+	case DropOldest:
+		for {
+			select {
+			case p.results <- res:
+				return true
+			default:
+			}
+			select {
+			case <-p.results:
+				p.stats.droppedOldest.Add(1)
+			default:
+			}
+		}
+
+	case SpillToDisk:
+		if p.spill != nil && p.spill.write(res) == nil {
+			p.stats.spilled.Add(1)
+			return true
+		}
+		// Spill file unusable: fall back to blocking
+
+	case FailWithError:
+		p.stats.failed.Add(1)
+		p.fail(fmt.Errorf("%w: job %d", ErrResultsFull, res.JobID))
+		return false
+	}
+
+	p.stats.blocked.Add(1)
+	select {
+	case p.results <- res:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// fail records the first fatal error and stops the pool
+func (p *Pool[In, Out]) fail(err error) {
+	p.errMu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.errMu.Unlock()
+	p.Stop()
+}
+
+// spillRecord is the on-disk form of a Result. Errors are kept as text
+// plus the name of the sentinel they wrap, if it is one of sentinels.
+type spillRecord[Out any] struct {
+	JobID    int    `json:"job_id"`
+	WorkerID int    `json:"worker_id"`
+	Value    Out    `json:"value"`
+	Err      string `json:"err,omitempty"`
+	Sentinel string `json:"sentinel,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// sentinels are the errors a spilled result still matches with errors.Is
+// after it is read back. Any other wrapped error is lost.
+var sentinels = map[string]error{
+	"panic":    ErrPanic,
+	"closed":   ErrClosed,
+	"canceled": context.Canceled,
+	"deadline": context.DeadlineExceeded,
+}
+
+// spilledError is an error read back from the spill file
+type spilledError struct {
+	msg      string
+	sentinel error
+}
+
+func (e spilledError) Error() string { return e.msg }
+func (e spilledError) Unwrap() error { return e.sentinel }
+
+// spillFile is an append-only JSON-lines file that overflowing results are
+// parked in until the consumer catches up
+type spillFile[Out any] struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	w       *os.File
+	r       *bufio.Reader
+	rf      *os.File
+	pending int
+	closed  bool
+}
+
+func newSpillFile[Out any](dir string) (*spillFile[Out], error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	w, err := os.CreateTemp(dir, "workerpool-spill-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	rf, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	s := &spillFile[Out]{w: w, rf: rf, r: bufio.NewReader(rf)}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+func (s *spillFile[Out]) write(res Result[Out]) error {
+	rec := spillRecord[Out]{JobID: res.JobID, WorkerID: res.WorkerID, Value: res.Value, Attempts: res.Attempts}
+	if res.Err != nil {
+		rec.Err = res.Err.Error()
+		for name, target := range sentinels {
+			if errors.Is(res.Err, target) {
+				rec.Sentinel = name
+				break
+			}
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.pending++
+	s.cond.Signal()
+	return nil
+}
+
+// next blocks until a spilled result is available. It returns false once
+// the file is closed and fully drained.
+func (s *spillFile[Out]) next() (Result[Out], bool) {
+	s.mu.Lock()
+	for s.pending == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.pending == 0 {
+		s.mu.Unlock()
+		return Result[Out]{}, false
+	}
+	s.pending--
+	s.mu.Unlock()
+
+	// Writers hold the lock for a whole line, so the line is complete
+	var rec spillRecord[Out]
+	line, err := s.r.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &rec)
+	}
+	res := Result[Out]{JobID: rec.JobID, WorkerID: rec.WorkerID, Value: rec.Value, Attempts: rec.Attempts}
+	if err != nil {
+		res.Err = fmt.Errorf("workerpool: reading spilled result: %w", err)
+	} else if rec.Err != "" {
+		res.Err = spilledError{msg: rec.Err, sentinel: sentinels[rec.Sentinel]}
+	}
+	return res, true
+}
+
+// close marks the end of writes; next drains what is left
+func (s *spillFile[Out]) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *spillFile[Out]) remove() {
+	s.w.Close()
+	s.rf.Close()
+	os.Remove(s.w.Name())
+}
@@ -0,0 +1,55 @@
+package workerpool
+
+import "metrics"
+
+// poolMetrics holds the instruments a pool updates while it runs. Every
+// field is nil, and therefore a no-op, unless the pool was created
+// WithMetrics.
+type poolMetrics struct {
+	duration  *metrics.Histogram
+	completed *metrics.Counter
+	failed    *metrics.Counter
+	retries   *metrics.Counter
+	panics    *metrics.Counter
+}
+
+// WithMetrics publishes the pool's metrics in reg, labelled pool=name:
+// queue depth, in-flight jobs, workers, job latency, failures, retries,
+// recovered panics and dropped results.
+func WithMetrics(reg *metrics.Registry, name string) Option {
+	return func(c *config) {
+		c.registry = reg
+		c.name = name
+	}
+}
+
+// instrument registers the pool's metrics
+func (p *Pool[In, Out]) instrument(reg *metrics.Registry, name string) {
+	labels := metrics.Labels{"pool": name}
+	p.metrics = poolMetrics{
+		duration:  reg.Histogram("workerpool_job_duration_seconds", "Time one job attempt took.", labels, nil),
+		completed: reg.Counter("workerpool_jobs_completed_total", "Jobs that finished without error.", labels),
+		failed:    reg.Counter("workerpool_jobs_failed_total", "Jobs that failed after their last attempt.", labels),
+		retries:   reg.Counter("workerpool_job_retries_total", "Job attempts that were retried.", labels),
+		panics:    reg.Counter("workerpool_panics_recovered_total", "Panics recovered in workers.", labels),
+	}
+
+	reg.GaugeFunc("workerpool_queue_depth", "Jobs queued or waiting in Submit.", labels,
+		func() float64 { return float64(p.Backlog()) })
+	reg.GaugeFunc("workerpool_jobs_in_flight", "Jobs currently running.", labels,
+		func() float64 { return float64(p.InFlight()) })
+	reg.GaugeFunc("workerpool_workers", "Running workers.", labels,
+		func() float64 { return float64(p.Workers()) })
+	reg.GaugeFunc("workerpool_dead_letters", "Jobs in the dead-letter queue.", labels,
+		func() float64 { return float64(p.dead.Len()) })
+
+	dropped := func(policy OverflowPolicy, n func() int64) {
+		reg.CounterFunc("workerpool_results_dropped_total", "Results discarded because the results buffer was full.",
+			metrics.Labels{"pool": name, "policy": policy.String()},
+			func() float64 { return float64(n()) })
+	}
+	dropped(DropNewest, p.stats.droppedNewest.Load)
+	dropped(DropOldest, p.stats.droppedOldest.Load)
+	reg.CounterFunc("workerpool_results_spilled_total", "Results parked on disk because the results buffer was full.", labels,
+		func() float64 { return float64(p.stats.spilled.Load()) })
+}
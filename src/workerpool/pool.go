@@ -0,0 +1,340 @@
+// Package workerpool provides a generic, context-aware worker pool.
+//
+// It replaces the hand-written worker/WaitGroup/close dance that the demos
+// in src/main used to copy around:
+//
+//	pool := workerpool.New(ctx, 3, process)
+//	go func() {
+//		for j := 1; j <= 6; j++ {
+//			pool.Submit(ctx, j, j)
+//		}
+//		pool.Close() // graceful drain
+//	}()
+//	for r := range pool.Results() {
+//		fmt.Println(r.JobID, r.Value, r.Err)
+//	}
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"metrics"
+)
+
+// ErrClosed is returned by Submit once Close or Stop has been called
+var ErrClosed = errors.New("workerpool: pool is closed")
+
+// Func processes one job payload. workerID is the 1-based worker number.
+type Func[In, Out any] func(ctx context.Context, workerID int, in In) (Out, error)
+
+// Job is a unit of work waiting in the pool
+type Job[In any] struct {
+	ID      int
+	Payload In
+	Retry   *RetryPolicy // overrides the pool's policy when set
+	Kind    string       // groups jobs for per-kind limits
+
+	release func() // frees the job's limiter slot once it is done
+}
+
+// Result carries the output of one job back to the caller. A result that
+// went through SpillToDisk keeps the text of Err, and errors.Is still
+// matches ErrPanic, ErrClosed and the context errors, but any other error
+// it wrapped is lost.
+type Result[Out any] struct {
+	JobID    int
+	WorkerID int
+	Value    Out
+	Err      error
+	Attempts int
+}
+
+// Pool runs a set of workers over a shared job queue
+type Pool[In, Out any] struct {
+	fn  Func[In, Out]
+	cfg config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	jobs    chan Job[In]
+	results chan Result[Out]
+
+	mu      sync.RWMutex // guards closed and sends on jobs
+	closed  bool
+	closing chan struct{} // closed by Close
+
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	nextID   atomic.Int64 // last worker ID handed out
+	active   atomic.Int64 // running workers
+	target   atomic.Int64 // workers the pool is sizing towards
+	shrink   chan struct{}
+	waiting  atomic.Int64 // producers blocked in Submit
+	inFlight atomic.Int64
+	avgNanos atomic.Int64
+
+	stats   counters
+	limiter atomic.Pointer[Limiter] // set by a dispatcher with limits
+	metrics poolMetrics
+	spill   *spillFile[Out]
+	dead    DeadLetterQueue[In]
+
+	errMu sync.Mutex
+	err   error
+}
+
+// Option configures a Pool
+type Option func(*config)
+
+type config struct {
+	queueSize   int
+	resultSize  int
+	overflow    OverflowPolicy
+	spillDir    string
+	autoscale   *AutoscaleConfig
+	retry       RetryPolicy
+	deadLetters bool
+	registry    *metrics.Registry
+	name        string
+}
+
+// WithQueueSize sets the buffer size of the job queue
+func WithQueueSize(n int) Option {
+	return func(c *config) { c.queueSize = n }
+}
+
+// WithResultBuffer sets the buffer size of the results channel
+func WithResultBuffer(n int) Option {
+	return func(c *config) { c.resultSize = n }
+}
+
+// New starts a pool with the given number of workers.
+// Cancelling ctx has the same effect as calling Stop.
+func New[In, Out any](ctx context.Context, workers int, fn Func[In, Out], opts ...Option) *Pool[In, Out] {
+	if workers < 1 {
+		workers = 1
+	}
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if as := cfg.autoscale; as != nil {
+		workers = min(max(workers, as.Min), as.Max)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Pool[In, Out]{
+		fn:      fn,
+		cfg:     cfg,
+		ctx:     ctx,
+		cancel:  cancel,
+		jobs:    make(chan Job[In], cfg.queueSize),
+		results: make(chan Result[Out], cfg.resultSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if cfg.registry != nil {
+		p.instrument(cfg.registry, cfg.name)
+	}
+
+	// If the spill file cannot be created SpillToDisk falls back to Block
+	replayed := make(chan struct{})
+	if cfg.overflow == SpillToDisk {
+		if spill, err := newSpillFile[Out](cfg.spillDir); err == nil {
+			p.spill = spill
+		}
+	}
+	if p.spill != nil {
+		go p.replay(replayed)
+	} else {
+		close(replayed)
+	}
+
+	for w := 1; w <= workers; w++ {
+		p.startWorker()
+	}
+	p.target.Store(int64(workers))
+	if cfg.autoscale != nil {
+		p.shrink = make(chan struct{}, cfg.autoscale.Max)
+		p.wg.Add(1)
+		go p.autoscale()
+	}
+
+	// Close results once every worker has exited and spilled results
+	// have been handed back
+	go func() {
+		p.wg.Wait()
+		// After Stop jobs can be left in the queue; they never run, so
+		// free their limiter slots
+		p.Close()
+		for job := range p.jobs {
+			if job.release != nil {
+				job.release()
+			}
+		}
+		if p.spill != nil {
+			p.spill.close()
+		}
+		<-replayed
+		close(p.results)
+		cancel()
+		close(p.done)
+	}()
+
+	return p
+}
+
+// Submit queues a job. It blocks while the queue is full and returns early
+// if ctx is cancelled, the pool is stopped, or the pool has been closed.
+func (p *Pool[In, Out]) Submit(ctx context.Context, id int, in In) error {
+	return p.SubmitJob(ctx, Job[In]{ID: id, Payload: in})
+}
+
+// SubmitJob is Submit for a job that carries its own retry policy
+func (p *Pool[In, Out]) SubmitJob(ctx context.Context, job Job[In]) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	p.waiting.Add(1)
+	defer p.waiting.Add(-1)
+
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// Results returns the channel results are delivered on.
+// It is closed after the last worker exits.
+func (p *Pool[In, Out]) Results() <-chan Result[Out] {
+	return p.results
+}
+
+// Close stops accepting jobs and lets workers drain what is already queued
+func (p *Pool[In, Out]) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+		close(p.closing)
+	}
+}
+
+// Stop cancels the pool immediately. Jobs still in the queue are discarded
+// and running jobs see their context cancelled.
+func (p *Pool[In, Out]) Stop() {
+	p.cancel()
+	p.Close()
+}
+
+// Wait blocks until every worker has exited and Results has been closed.
+// The caller must keep draining Results, otherwise Wait can block forever.
+func (p *Pool[In, Out]) Wait() {
+	<-p.done
+}
+
+// Workers returns the number of running workers
+func (p *Pool[In, Out]) Workers() int {
+	return int(p.active.Load())
+}
+
+func (p *Pool[In, Out]) startWorker() {
+	p.wg.Add(1)
+	p.active.Add(1)
+	go p.worker(int(p.nextID.Add(1)))
+}
+
+func (p *Pool[In, Out]) worker(id int) {
+	defer p.wg.Done()
+	defer p.active.Add(-1)
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.shrink:
+			// Retired by the autoscaler
+			return
+		case job, ok := <-p.jobs:
+			if !ok {
+				return
+			}
+			// Stop may have raced with the receive
+			if p.ctx.Err() != nil {
+				if job.release != nil {
+					job.release()
+				}
+				return
+			}
+			res := p.process(id, job)
+			if job.release != nil {
+				job.release()
+			}
+			if !p.deliver(res) {
+				return
+			}
+		}
+	}
+}
+
+// replay feeds spilled results back into the results channel
+func (p *Pool[In, Out]) replay(done chan<- struct{}) {
+	defer close(done)
+	defer p.spill.remove()
+
+	for {
+		res, ok := p.spill.next()
+		if !ok {
+			return
+		}
+		select {
+		case p.results <- res:
+		case <-p.ctx.Done():
+			// Stopped: keep draining so close() does not wait forever
+		}
+	}
+}
+
+// run executes one attempt of a job, turning a panic into an error so a
+// single bad job cannot take the worker down with it
+func (p *Pool[In, Out]) run(workerID int, job Job[In], attempt int) (res Result[Out]) {
+	res = Result[Out]{JobID: job.ID, WorkerID: workerID}
+
+	p.inFlight.Add(1)
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		p.inFlight.Add(-1)
+		p.observe(d)
+		p.metrics.duration.Observe(d.Seconds())
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			p.metrics.panics.Inc()
+			res.Err = fmt.Errorf("%w: worker %d, job %d: %v", ErrPanic, workerID, job.ID, r)
+		}
+	}()
+
+	ctx := context.WithValue(p.ctx, attemptKey{}, attempt)
+	res.Value, res.Err = p.fn(ctx, workerID, job.Payload)
+	return res
+}
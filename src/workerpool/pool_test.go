@@ -0,0 +1,450 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"metrics"
+)
+
+func TestPoolDrainsOnClose(t *testing.T) {
+	ctx := context.Background()
+	pool := New(ctx, 3, func(ctx context.Context, workerID int, n int) (int, error) {
+		if n == 4 {
+			panic("bad job")
+		}
+		return n * 2, nil
+	})
+
+	go func() {
+		for j := 1; j <= 6; j++ {
+			pool.Submit(ctx, j, j)
+		}
+		pool.Close()
+	}()
+
+	got := map[int]int{}
+	failed := 0
+	for r := range pool.Results() {
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		got[r.JobID] = r.Value
+	}
+
+	if len(got) != 5 || failed != 1 {
+		t.Fatalf("got %d results and %d errors; expected 5 and 1", len(got), failed)
+	}
+	for id, v := range got {
+		if v != id*2 {
+			t.Errorf("job %d = %d; expected %d", id, v, id*2)
+		}
+	}
+	if err := pool.Submit(ctx, 7, 7); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit after Close = %v; expected ErrClosed", err)
+	}
+}
+
+func TestPoolStopCancelsRunningJobs(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	pool := New(ctx, 1, func(ctx context.Context, workerID int, n int) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}, WithQueueSize(10))
+
+	for j := 1; j <= 5; j++ {
+		pool.Submit(ctx, j, j)
+	}
+	<-started
+	pool.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		for range pool.Results() {
+		}
+		pool.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pool did not stop")
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	ctx := context.Background()
+	double := func(ctx context.Context, workerID int, n int) (int, error) { return n * 2, nil }
+
+	t.Run("drop-newest", func(t *testing.T) {
+		pool := New(ctx, 1, double, WithQueueSize(5), WithResultBuffer(1), WithOverflowPolicy(DropNewest))
+		for j := 1; j <= 5; j++ {
+			pool.Submit(ctx, j, j)
+		}
+		pool.Close()
+		pool.Wait() // never blocks: overflowing results are dropped
+
+		got := 0
+		for range pool.Results() {
+			got++
+		}
+		if got != 1 || pool.Stats().DroppedNewest != 4 {
+			t.Errorf("got %d results, %d dropped; expected 1 and 4", got, pool.Stats().DroppedNewest)
+		}
+	})
+
+	t.Run("spill-to-disk", func(t *testing.T) {
+		fn := func(ctx context.Context, workerID int, n int) (int, error) {
+			if n == 4 {
+				panic("bad job")
+			}
+			return n * 2, nil
+		}
+		pool := New(ctx, 1, fn, WithQueueSize(5), WithResultBuffer(1),
+			WithOverflowPolicy(SpillToDisk), WithSpillDir(t.TempDir()))
+		for j := 1; j <= 5; j++ {
+			pool.Submit(ctx, j, j)
+		}
+		pool.Close()
+		time.Sleep(50 * time.Millisecond) // let the worker overflow
+
+		seen := map[int]bool{}
+		for r := range pool.Results() {
+			switch {
+			case r.Attempts != 1:
+				t.Errorf("job %d made %d attempts; expected 1", r.JobID, r.Attempts)
+			case r.JobID == 4 && !errors.Is(r.Err, ErrPanic):
+				t.Errorf("job 4 error %v; expected ErrPanic", r.Err)
+			case r.JobID != 4 && r.Value != r.JobID*2:
+				t.Errorf("job %d = %d; expected %d", r.JobID, r.Value, r.JobID*2)
+			}
+			seen[r.JobID] = true
+		}
+		if len(seen) != 5 || pool.Stats().Spilled == 0 {
+			t.Errorf("got %d results, %d spilled; expected 5 and >0", len(seen), pool.Stats().Spilled)
+		}
+	})
+
+	t.Run("fail-with-error", func(t *testing.T) {
+		pool := New(ctx, 1, double, WithQueueSize(5), WithResultBuffer(1), WithOverflowPolicy(FailWithError))
+		for j := 1; j <= 5; j++ {
+			pool.Submit(ctx, j, j)
+		}
+		pool.Close()
+		pool.Wait()
+
+		if !errors.Is(pool.Err(), ErrResultsFull) || pool.Stats().Failed != 1 {
+			t.Errorf("Err() = %v, failed = %d; expected ErrResultsFull and 1", pool.Err(), pool.Stats().Failed)
+		}
+	})
+}
+
+func TestDispatcherPriorityOrder(t *testing.T) {
+	ctx := context.Background()
+	gate := make(chan struct{})
+	var order []int
+
+	// One worker, unbuffered queue: the dispatcher picks at hand-off time
+	pool := New(ctx, 1, func(ctx context.Context, workerID int, p int) (int, error) {
+		if p < 0 {
+			<-gate
+		}
+		order = append(order, p)
+		return p, nil
+	})
+	d := NewDispatcher[int](ctx, pool, func(p int) int { return p }, 0)
+
+	d.Submit(ctx, 0, -1) // occupies the worker
+	for d.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i, p := range []int{1, 3, 2, 3} {
+		d.Submit(ctx, i+1, p)
+	}
+	d.Close()
+	close(gate)
+	for range pool.Results() {
+	}
+
+	// The dispatcher holds one popped job while the worker is busy
+	expected := []int{-1, 1, 3, 3, 2}
+	if fmt.Sprint(order) != fmt.Sprint(expected) && fmt.Sprint(order) != fmt.Sprint([]int{-1, 3, 3, 2, 1}) {
+		t.Errorf("order = %v; expected %v", order, expected)
+	}
+	if stats := d.Stats(); len(stats) != 4 || stats[0].Priority != 3 || stats[0].Count != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAutoscaleGrowsAndShrinks(t *testing.T) {
+	ctx := context.Background()
+	events := make(chan ScaleEvent, 100)
+	pool := New(ctx, 1, func(ctx context.Context, workerID int, n int) (int, error) {
+		time.Sleep(20 * time.Millisecond)
+		return n, nil
+	},
+		WithQueueSize(40),
+		WithResultBuffer(40),
+		WithAutoscale(AutoscaleConfig{
+			Min:           1,
+			Max:           4,
+			Interval:      10 * time.Millisecond,
+			TargetLatency: 50 * time.Millisecond,
+			OnScale:       func(e ScaleEvent) { events <- e },
+		}),
+	)
+
+	for j := 1; j <= 40; j++ {
+		pool.Submit(ctx, j, j)
+	}
+
+	peak, last := 0, 1
+	deadline := time.After(5 * time.Second)
+	for peak < 4 || last > 1 {
+		select {
+		case e := <-events:
+			peak, last = max(peak, e.To), e.To
+		case <-deadline:
+			t.Fatalf("peak %d workers, now %d; expected to reach 4 and return to 1", peak, last)
+		}
+	}
+
+	pool.Close()
+	got := 0
+	for range pool.Results() {
+		got++
+	}
+	if got != 40 {
+		t.Errorf("got %d results; expected 40", got)
+	}
+}
+
+func TestResizeWithBusyWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gate := make(chan struct{})
+	pool := New(ctx, 4, func(ctx context.Context, workerID int, n int) (int, error) {
+		<-gate
+		return n, nil
+	},
+		WithQueueSize(8),
+		WithResultBuffer(8),
+		WithAutoscale(AutoscaleConfig{Min: 1, Max: 4, Interval: time.Hour}),
+	)
+	for j := 1; j <= 4; j++ {
+		pool.Submit(ctx, j, j)
+	}
+	for pool.InFlight() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Retirements wait for the busy workers; growing again cancels them
+	// rather than starting workers beyond Max
+	resized := make(chan struct{})
+	go func() {
+		defer close(resized)
+		for i := 0; i < 3; i++ {
+			pool.resize(4, 1)
+			pool.resize(1, 4)
+		}
+		pool.resize(4, 1)
+	}()
+	select {
+	case <-resized:
+	case <-time.After(time.Second):
+		t.Fatal("resize blocked on busy workers")
+	}
+	if n := pool.Workers(); n != 4 {
+		t.Errorf("%d workers while busy; expected 4", n)
+	}
+
+	close(gate)
+	for deadline := time.Now().Add(time.Second); pool.Workers() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers after the jobs finished; expected 1", pool.Workers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if pool.resize(1, 2) {
+		t.Error("resize succeeded after the context was cancelled")
+	}
+	for range pool.Results() {
+	}
+}
+
+func TestRetryAndDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	pool := New(ctx, 2, func(ctx context.Context, workerID int, n int) (int, error) {
+		switch {
+		case n == 1 && Attempt(ctx) < 2:
+			panic("flaky")
+		case n == 2:
+			return 0, Permanent(errors.New("bad input"))
+		case n == 3:
+			return 0, errors.New("always fails")
+		}
+		return n, nil
+	},
+		WithQueueSize(4),
+		WithResultBuffer(4),
+		WithRetry(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Jitter: 0.5}),
+		WithDeadLetters(),
+	)
+
+	for j := 1; j <= 4; j++ {
+		pool.Submit(ctx, j, j)
+	}
+	pool.Close()
+
+	attempts := map[int]int{}
+	for r := range pool.Results() {
+		attempts[r.JobID] = r.Attempts
+	}
+	expected := map[int]int{1: 2, 2: 1, 3: 3, 4: 1}
+	if fmt.Sprint(attempts) != fmt.Sprint(expected) {
+		t.Errorf("attempts = %v; expected %v", attempts, expected)
+	}
+
+	dead := pool.DeadLetters().List()
+	if len(dead) != 2 {
+		t.Fatalf("got %d dead letters; expected 2", len(dead))
+	}
+
+	// Replaying into a closed pool keeps the dead letters
+	n, err := pool.DeadLetters().Replay(ctx, pool.SubmitJob)
+	if n != 0 || !errors.Is(err, ErrClosed) || pool.DeadLetters().Len() != 2 {
+		t.Errorf("Replay = %d, %v with %d left; expected 0, ErrClosed, 2", n, err, pool.DeadLetters().Len())
+	}
+}
+
+func TestDispatcherKindLimits(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	running, peak := 0, 0
+
+	pool := New(ctx, 3, func(ctx context.Context, workerID int, kind string) (string, error) {
+		if kind == "file" {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}
+		return kind, nil
+	}, WithResultBuffer(20))
+
+	limiter := NewLimiter()
+	limiter.SetLimit("file", Limit{MaxConcurrent: 1})
+	limiter.SetLimit("calc", Limit{Rate: 50, Burst: 1})
+	d := NewDispatcher[string](ctx, pool, func(string) int { return 0 }, 0,
+		WithLimiter(limiter, func(kind string) string { return kind }))
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		kind := "file"
+		if i%2 == 0 {
+			kind = "calc"
+		}
+		d.Submit(ctx, i, kind)
+	}
+	d.Close()
+	for range pool.Results() {
+	}
+
+	if peak != 1 {
+		t.Errorf("peak concurrent file jobs = %d; expected 1", peak)
+	}
+	// 5 calc jobs at 50/s with burst 1 need at least 80ms
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("finished in %v; rate limit not applied", elapsed)
+	}
+	kinds := pool.Stats().Kinds
+	if len(kinds) != 2 {
+		t.Fatalf("pool stats report %d kinds; expected 2", len(kinds))
+	}
+	for _, s := range kinds {
+		if s.Admitted != 5 || s.Running != 0 {
+			t.Errorf("%s: admitted %d, running %d; expected 5 and 0", s.Kind, s.Admitted, s.Running)
+		}
+	}
+}
+
+func TestStopReleasesKindSlots(t *testing.T) {
+	ctx := context.Background()
+	pool := New(ctx, 1, func(ctx context.Context, workerID int, n int) (int, error) {
+		<-ctx.Done()
+		return n, ctx.Err()
+	}, WithQueueSize(4), WithResultBuffer(10))
+
+	limiter := NewLimiter()
+	limiter.SetLimit("job", Limit{MaxConcurrent: 10})
+	d := NewDispatcher[int](ctx, pool, func(int) int { return 0 }, 0,
+		WithLimiter(limiter, func(int) string { return "job" }))
+	for i := 0; i < 5; i++ {
+		d.Submit(ctx, i, i)
+	}
+	for d.Len() > 0 || pool.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// One job running, four waiting in the pool's queue
+	pool.Stop()
+	for range pool.Results() {
+	}
+	if s := limiter.Stats(); len(s) != 1 || s[0].Running != 0 {
+		t.Errorf("limiter stats after Stop: %+v; expected nothing running", s)
+	}
+
+	// The dispatcher finds out when it next hands a job over, and
+	// refuses jobs from then on
+	d.Submit(ctx, 5, 5)
+	d.Wait()
+	if err := d.Submit(ctx, 6, 6); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit after the pool stopped = %v; expected ErrClosed", err)
+	}
+}
+
+func TestPoolMetrics(t *testing.T) {
+	ctx := context.Background()
+	reg := metrics.NewRegistry()
+	pool := New(ctx, 2, func(ctx context.Context, workerID int, n int) (int, error) {
+		if n == 3 {
+			panic("boom")
+		}
+		return n, nil
+	}, WithMetrics(reg, "test"), WithOverflowPolicy(DropNewest))
+
+	for i := 1; i <= 5; i++ {
+		pool.Submit(ctx, i, i)
+	}
+	pool.Close()
+	pool.Wait() // nobody reads results, so every one is dropped
+
+	var out strings.Builder
+	reg.WriteTo(&out)
+	for _, line := range []string{
+		`workerpool_jobs_completed_total{pool="test"} 4`,
+		`workerpool_jobs_failed_total{pool="test"} 1`,
+		`workerpool_panics_recovered_total{pool="test"} 1`,
+		`workerpool_results_dropped_total{policy="drop-newest",pool="test"} 5`,
+		`workerpool_job_duration_seconds_count{pool="test"} 5`,
+		`workerpool_queue_depth{pool="test"} 0`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package workerpool
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Submitter is anything a dispatcher can hand jobs to, such as a *Pool
+type Submitter[In any] interface {
+	SubmitJob(ctx context.Context, job Job[In]) error
+	Close()
+}
+
+// PriorityStats summarises how long jobs of one priority waited in the
+// dispatcher before a worker picked them up
+type PriorityStats struct {
+	Priority int
+	Count    int
+	Mean     time.Duration
+	Max      time.Duration
+}
+
+// Dispatcher sits between producers and a pool and always hands the
+// highest-priority job to the next free worker. Larger Priority values run
+// first. Waiting jobs gain one priority level per aging interval so a steady
+// stream of urgent work cannot starve the rest.
+//
+// Use it with a pool whose queue size is 0, so the choice is made when a
+// worker is actually free rather than when the job is buffered.
+type Dispatcher[In any] struct {
+	target   Submitter[In]
+	priority func(In) int
+	aging    time.Duration
+	epoch    time.Time
+	ctx      context.Context
+	limiter  *Limiter
+	kind     func(In) string
+
+	mu     sync.Mutex
+	wake   chan struct{} // closed and replaced when jobs arrive or Close is called
+	queue  priorityHeap[In]
+	seq    int64
+	closed bool
+	stats  map[int]*PriorityStats
+	total  map[int]time.Duration
+
+	done chan struct{}
+}
+
+// DispatcherOption configures a Dispatcher
+type DispatcherOption[In any] func(*Dispatcher[In])
+
+// WithLimiter makes the dispatcher respect per-kind limits. kind names the
+// kind of a payload. A job whose kind is at its limit is passed over for
+// the next eligible job, so one throttled kind does not hold up the rest.
+func WithLimiter[In any](l *Limiter, kind func(In) string) DispatcherOption[In] {
+	return func(d *Dispatcher[In]) {
+		d.limiter = l
+		d.kind = kind
+	}
+}
+
+// NewDispatcher starts dispatching to target. priority extracts the priority
+// of a payload; aging of 0 disables aging.
+func NewDispatcher[In any](ctx context.Context, target Submitter[In], priority func(In) int, aging time.Duration, opts ...DispatcherOption[In]) *Dispatcher[In] {
+	d := &Dispatcher[In]{
+		target:   target,
+		priority: priority,
+		aging:    aging,
+		epoch:    time.Now(),
+		ctx:      ctx,
+		wake:     make(chan struct{}),
+		stats:    make(map[int]*PriorityStats),
+		total:    make(map[int]time.Duration),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if l, ok := target.(interface{ reportLimits(*Limiter) }); ok && d.limiter != nil {
+		l.reportLimits(d.limiter)
+	}
+
+	go d.run()
+	return d
+}
+
+// Submit queues a job. It never blocks. It returns ErrClosed after Close,
+// or once the target has refused a job or ctx of NewDispatcher is done.
+func (d *Dispatcher[In]) Submit(ctx context.Context, id int, in In) error {
+	return d.SubmitJob(ctx, Job[In]{ID: id, Payload: in})
+}
+
+// SubmitJob is Submit for a job that carries its own retry policy or kind
+func (d *Dispatcher[In]) SubmitJob(ctx context.Context, job Job[In]) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if job.Kind == "" && d.kind != nil {
+		job.Kind = d.kind(job.Payload)
+	}
+
+	d.seq++
+	now := time.Now()
+	p := d.priority(job.Payload)
+	heap.Push(&d.queue, &priorityItem[In]{
+		job:      job,
+		priority: p,
+		key:      d.key(p, now),
+		seq:      d.seq,
+		queued:   now,
+	})
+	d.signal()
+	return nil
+}
+
+// Close stops accepting jobs. Queued jobs are still dispatched, then the
+// target is closed.
+func (d *Dispatcher[In]) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.signal()
+	d.mu.Unlock()
+}
+
+// signal wakes the dispatch loop. Caller holds d.mu.
+func (d *Dispatcher[In]) signal() {
+	close(d.wake)
+	d.wake = make(chan struct{})
+}
+
+// Wait blocks until the dispatcher has handed off its last job
+func (d *Dispatcher[In]) Wait() {
+	<-d.done
+}
+
+// Len returns the number of jobs waiting to be dispatched
+func (d *Dispatcher[In]) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queue.Len()
+}
+
+// Stats returns queue-wait statistics per priority, highest priority first
+func (d *Dispatcher[In]) Stats() []PriorityStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := make([]PriorityStats, 0, len(d.stats))
+	for p, s := range d.stats {
+		st := *s
+		if st.Count > 0 {
+			st.Mean = d.total[p] / time.Duration(st.Count)
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Priority > out[j].Priority })
+	return out
+}
+
+// key is the effective priority as of the dispatcher's start time. With
+// linear aging every job gains priority at the same rate, so comparing keys
+// once is enough and the heap never needs re-sorting.
+func (d *Dispatcher[In]) key(priority int, queued time.Time) float64 {
+	if d.aging <= 0 {
+		return float64(priority)
+	}
+	return float64(priority) - float64(queued.Sub(d.epoch))/float64(d.aging)
+}
+
+func (d *Dispatcher[In]) run() {
+	defer close(d.done)
+	defer d.target.Close()
+	defer func() {
+		// Nothing is dispatched any more, so refuse new jobs
+		d.mu.Lock()
+		d.closed = true
+		d.mu.Unlock()
+	}()
+
+	for {
+		d.mu.Lock()
+		if d.queue.Len() == 0 && d.closed {
+			d.mu.Unlock()
+			return
+		}
+		item, retry, changed := d.pick()
+		wake := d.wake
+		d.mu.Unlock()
+
+		if item == nil {
+			select {
+			case <-wake:
+			case <-changed:
+			case <-d.ctx.Done():
+				return
+			case <-after(retry):
+			}
+			continue
+		}
+
+		// Blocks until a worker takes the job
+		if err := d.target.SubmitJob(d.ctx, item.job); err != nil {
+			if item.job.release != nil {
+				item.job.release()
+			}
+			return
+		}
+		d.record(item.priority, time.Since(item.queued))
+	}
+}
+
+// pick pops the highest-priority job the limiter lets through. If nothing
+// can run it returns nil and how long until a token frees up: 0 means wait
+// for a running job to finish, -1 means wait for new jobs. changed is the
+// limiter's channel as of the attempt, taken under its lock so a release
+// right after pick gives up still wakes the caller. Caller holds d.mu.
+func (d *Dispatcher[In]) pick() (item *priorityItem[In], retry time.Duration, changed <-chan struct{}) {
+	if d.queue.Len() == 0 {
+		return nil, -1, nil
+	}
+	if d.limiter == nil {
+		return heap.Pop(&d.queue).(*priorityItem[In]), 0, nil
+	}
+
+	var skipped []*priorityItem[In]
+	defer func() {
+		for _, it := range skipped {
+			heap.Push(&d.queue, it)
+		}
+	}()
+
+	d.limiter.mu.Lock()
+	defer d.limiter.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	for d.queue.Len() > 0 {
+		item := heap.Pop(&d.queue).(*priorityItem[In])
+		kind := item.job.Kind
+		ok, retry := d.limiter.tryAcquire(kind, now)
+		if ok {
+			item.job.release = func() { d.limiter.release(kind) }
+			return item, 0, nil
+		}
+		if !item.throttled {
+			d.limiter.state(kind).throttled++
+			item.throttled = true
+		}
+		if retry > 0 && (wait == 0 || retry < wait) {
+			wait = retry
+		}
+		skipped = append(skipped, item)
+	}
+	return nil, wait, d.limiter.changed
+}
+
+// after is time.After that never fires for d <= 0
+func after(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return time.After(d)
+}
+
+func (d *Dispatcher[In]) record(priority int, wait time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.stats[priority]
+	if !ok {
+		s = &PriorityStats{Priority: priority}
+		d.stats[priority] = s
+	}
+	s.Count++
+	d.total[priority] += wait
+	if wait > s.Max {
+		s.Max = wait
+	}
+}
+
+type priorityItem[In any] struct {
+	job       Job[In]
+	priority  int
+	key       float64
+	seq       int64
+	queued    time.Time
+	throttled bool
+}
+
+// priorityHeap is a max-heap on key, FIFO among equal keys
+type priorityHeap[In any] []*priorityItem[In]
+
+func (h priorityHeap[In]) Len() int { return len(h) }
+
+func (h priorityHeap[In]) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key > h[j].key
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap[In]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap[In]) Push(x any) { *h = append(*h, x.(*priorityItem[In])) }
+
+func (h *priorityHeap[In]) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
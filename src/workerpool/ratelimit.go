@@ -0,0 +1,178 @@
+package workerpool
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limit caps one kind of job. Zero values mean unlimited.
+type Limit struct {
+	Rate          float64 // jobs started per second
+	Burst         int     // jobs that may start at once after an idle period (default: ceil(Rate))
+	MaxConcurrent int     // jobs of this kind running at the same time
+}
+
+// KindStats reports the limit and usage of one kind of job
+type KindStats struct {
+	Kind      string
+	Limit     Limit
+	Running   int
+	Admitted  int64 // jobs started
+	Throttled int64 // jobs that had to wait for the limit
+}
+
+type kindState struct {
+	limit     Limit
+	tokens    float64
+	last      time.Time
+	running   int
+	admitted  int64
+	throttled int64
+}
+
+// Limiter enforces per-kind token-bucket and concurrency limits.
+// Limits can be changed while jobs are running.
+type Limiter struct {
+	mu      sync.Mutex
+	kinds   map[string]*kindState
+	changed chan struct{} // closed and replaced whenever capacity may have freed up
+}
+
+// NewLimiter returns a limiter with no limits set
+func NewLimiter() *Limiter {
+	return &Limiter{
+		kinds:   make(map[string]*kindState),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetLimit sets or replaces the limit for kind
+func (l *Limiter) SetLimit(kind string, limit Limit) {
+	if limit.Rate > 0 && limit.Burst < 1 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.state(kind)
+	s.limit = limit
+	s.tokens = min(s.tokens, float64(limit.Burst))
+	l.broadcast()
+}
+
+// RemoveLimit lifts every limit on kind
+func (l *Limiter) RemoveLimit(kind string) {
+	l.SetLimit(kind, Limit{})
+}
+
+// Acquire blocks until a job of kind may start. The returned function must
+// be called when the job finishes.
+func (l *Limiter) Acquire(ctx context.Context, kind string) (func(), error) {
+	throttled := false
+	for {
+		l.mu.Lock()
+		ok, retry := l.tryAcquire(kind, time.Now())
+		if !ok && !throttled {
+			l.state(kind).throttled++
+			throttled = true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		if ok {
+			return func() { l.release(kind) }, nil
+		}
+		if err := waitChange(ctx, changed, retry); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Stats returns usage per kind, sorted by kind
+func (l *Limiter) Stats() []KindStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]KindStats, 0, len(l.kinds))
+	for kind, s := range l.kinds {
+		out = append(out, KindStats{
+			Kind:      kind,
+			Limit:     s.limit,
+			Running:   s.running,
+			Admitted:  s.admitted,
+			Throttled: s.throttled,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Kind < out[j].Kind })
+	return out
+}
+
+func (l *Limiter) state(kind string) *kindState {
+	s, ok := l.kinds[kind]
+	if !ok {
+		s = &kindState{}
+		l.kinds[kind] = s
+	}
+	return s
+}
+
+// tryAcquire takes a concurrency slot and a token if both are available.
+// When only the rate is in the way, retry says when a token will be ready;
+// a zero retry means wait for a running job to finish. Caller holds l.mu.
+func (l *Limiter) tryAcquire(kind string, now time.Time) (bool, time.Duration) {
+	s := l.state(kind)
+	lim := s.limit
+
+	if lim.MaxConcurrent > 0 && s.running >= lim.MaxConcurrent {
+		return false, 0
+	}
+	if lim.Rate > 0 {
+		if s.last.IsZero() {
+			s.tokens = float64(lim.Burst)
+		} else {
+			s.tokens = min(s.tokens+now.Sub(s.last).Seconds()*lim.Rate, float64(lim.Burst))
+		}
+		s.last = now
+		if s.tokens < 1 {
+			return false, time.Duration((1 - s.tokens) / lim.Rate * float64(time.Second))
+		}
+		s.tokens--
+	}
+
+	s.running++
+	s.admitted++
+	return true, 0
+}
+
+func (l *Limiter) release(kind string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state(kind).running--
+	l.broadcast()
+}
+
+func (l *Limiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// waitChange waits for changed, for retry to pass (if non-zero), or for ctx
+func waitChange(ctx context.Context, changed <-chan struct{}, retry time.Duration) error {
+	var timeout <-chan time.Time
+	if retry > 0 {
+		timer := time.NewTimer(retry)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+	case <-timeout:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
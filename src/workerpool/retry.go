@@ -0,0 +1,198 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrPanic wraps the error produced when a job panics, so Retryable
+// functions can tell panics apart from returned errors
+var ErrPanic = errors.New("workerpool: job panicked")
+
+// RetryPolicy controls how often and how quickly a failing job is retried
+type RetryPolicy struct {
+	// MaxAttempts counts the first try; 0 or 1 means no retries
+	MaxAttempts int
+
+	// Delay before attempt n+1 is BaseDelay * Multiplier^(n-1), capped at MaxDelay
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64 // default 2
+
+	// Jitter randomises each delay by up to this fraction (0..1)
+	Jitter float64
+
+	// Retryable reports whether err is worth another attempt. nil retries
+	// everything except Permanent errors and context cancellation.
+	Retryable func(error) bool
+}
+
+// Backoff returns the delay to wait after the given failed attempt (1-based)
+func (r RetryPolicy) Backoff(attempt int) time.Duration {
+	mult := r.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(r.BaseDelay) * math.Pow(mult, float64(attempt-1))
+	if r.MaxDelay > 0 && d > float64(r.MaxDelay) {
+		d = float64(r.MaxDelay)
+	}
+	if r.Jitter > 0 {
+		j := min(r.Jitter, 1)
+		d = d * (1 - j + 2*j*rand.Float64())
+	}
+	return time.Duration(d)
+}
+
+// ShouldRetry reports whether err is worth another attempt under r, ignoring
+// MaxAttempts
+func (r RetryPolicy) ShouldRetry(err error) bool {
+	if errors.As(err, new(permanentError)) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+	return true
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// WithRetry sets the default retry policy for jobs submitted without one
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *config) { c.retry = policy }
+}
+
+// WithDeadLetters keeps jobs that fail every attempt in DeadLetters()
+func WithDeadLetters() Option {
+	return func(c *config) { c.deadLetters = true }
+}
+
+type attemptKey struct{}
+
+// Attempt returns the 1-based attempt number of the job running with ctx
+func Attempt(ctx context.Context) int {
+	if n, ok := ctx.Value(attemptKey{}).(int); ok {
+		return n
+	}
+	return 1
+}
+
+// DeadLetter is a job that failed on every allowed attempt
+type DeadLetter[In any] struct {
+	Job      Job[In]
+	Err      error
+	Attempts int
+	WorkerID int
+	Time     time.Time
+}
+
+// DeadLetterQueue keeps jobs that exhausted their retries so they can be
+// inspected and replayed
+type DeadLetterQueue[In any] struct {
+	mu    sync.Mutex
+	items []DeadLetter[In]
+}
+
+func (q *DeadLetterQueue[In]) add(dl DeadLetter[In]) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, dl)
+}
+
+// Len returns the number of dead-lettered jobs
+func (q *DeadLetterQueue[In]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// List returns a copy of the dead-lettered jobs, oldest first
+func (q *DeadLetterQueue[In]) List() []DeadLetter[In] {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]DeadLetter[In](nil), q.items...)
+}
+
+// Replay removes every dead letter and hands its job to submit, typically
+// a pool's SubmitJob. Jobs that cannot be resubmitted stay in the queue.
+func (q *DeadLetterQueue[In]) Replay(ctx context.Context, submit func(context.Context, Job[In]) error) (int, error) {
+	q.mu.Lock()
+	items := q.items
+	q.items = nil
+	q.mu.Unlock()
+
+	for i, dl := range items {
+		if err := submit(ctx, dl.Job); err != nil {
+			q.mu.Lock()
+			q.items = append(items[i:], q.items...)
+			q.mu.Unlock()
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+// DeadLetters returns the pool's dead-letter queue. It stays empty unless
+// the pool was created WithDeadLetters.
+func (p *Pool[In, Out]) DeadLetters() *DeadLetterQueue[In] {
+	return &p.dead
+}
+
+// process runs a job with retries and dead-letters it if every attempt fails
+func (p *Pool[In, Out]) process(workerID int, job Job[In]) Result[Out] {
+	policy := p.cfg.retry
+	if job.Retry != nil {
+		policy = *job.Retry
+	}
+
+	for attempt := 1; ; attempt++ {
+		res := p.run(workerID, job, attempt)
+		res.Attempts = attempt
+		if res.Err == nil {
+			p.metrics.completed.Inc()
+			return res
+		}
+
+		if attempt >= policy.MaxAttempts || !policy.ShouldRetry(res.Err) {
+			p.metrics.failed.Inc()
+			if !p.cfg.deadLetters {
+				return res
+			}
+			job.release = nil // the limiter slot is freed by the worker
+			p.dead.add(DeadLetter[In]{
+				Job:      job,
+				Err:      res.Err,
+				Attempts: attempt,
+				WorkerID: workerID,
+				Time:     time.Now(),
+			})
+			return res
+		}
+
+		p.metrics.retries.Inc()
+		timer := time.NewTimer(policy.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-p.ctx.Done():
+			timer.Stop()
+			return res
+		}
+	}
+}